@@ -0,0 +1,107 @@
+package main
+
+import "fmt"
+import "io"
+import "os"
+import "bytes"
+import "errors"
+import "strings"
+import "net/url"
+import "net/http"
+import "crypto/tls"
+import "crypto/x509"
+import "encoding/json"
+import . "github.com/nt1m/Peerster/types"
+
+func apiURL(path string) string {
+  if *node != "" {
+    path = "/nodes/" + url.PathEscape(*node) + path
+  }
+  scheme := "http"
+  if *certFile != "" {
+    scheme = "https"
+  }
+  return scheme + "://127.0.0.1:" + *UIPort + path
+}
+
+// Client trusting the node's self-signed certificate, if one is given.
+func httpClient() (*http.Client, error) {
+  if *certFile == "" {
+    return http.DefaultClient, nil
+  }
+  pem, err := os.ReadFile(*certFile)
+  if err != nil {
+    return nil, err
+  }
+  roots := x509.NewCertPool()
+  if !roots.AppendCertsFromPEM(pem) {
+    return nil, errors.New("no certificate found in " + *certFile)
+  }
+  return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}, nil
+}
+
+func doRequest(request *http.Request) (*http.Response, error) {
+  client, err := httpClient()
+  if err != nil {
+    return nil, err
+  }
+  if *token != "" {
+    request.Header.Set("Authorization", "Bearer " + *token)
+  }
+  return client.Do(request)
+}
+
+func checkResponse(response *http.Response) error {
+  if response.StatusCode == http.StatusOK || response.StatusCode == http.StatusAccepted {
+    return nil
+  }
+  body, _ := io.ReadAll(response.Body)
+  var uiErr UIError
+  if json.Unmarshal(body, &uiErr) == nil && uiErr.Message != "" {
+    return fmt.Errorf("%s", uiErr.Message)
+  }
+  if text := strings.TrimSpace(string(body)); text != "" {
+    return fmt.Errorf("%s: %s", response.Status, text)
+  }
+  return fmt.Errorf("%s", response.Status)
+}
+
+// Fetches path from the node's web server and decodes the JSON reply into v.
+func apiGet(path string, v interface{}) error {
+  request, err := http.NewRequest("GET", apiURL(path), nil)
+  if err != nil {
+    return err
+  }
+  response, err := doRequest(request)
+  if err != nil {
+    return err
+  }
+  defer response.Body.Close()
+  if err := checkResponse(response); err != nil {
+    return err
+  }
+  return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Sends body to the node's web server, returning whether it was only queued.
+func apiRequest(method, path, contentType string, body []byte) (bool, error) {
+  request, err := http.NewRequest(method, apiURL(path), bytes.NewReader(body))
+  if err != nil {
+    return false, err
+  }
+  request.Header.Set("Content-Type", contentType)
+  response, err := doRequest(request)
+  if err != nil {
+    return false, err
+  }
+  defer response.Body.Close()
+  return response.StatusCode == http.StatusAccepted, checkResponse(response)
+}
+
+func postMessage(msg *Message) (bool, error) {
+  body, err := json.Marshal(msg)
+  if err != nil {
+    return false, err
+  }
+  return apiRequest("POST", "/message", "application/json", body)
+}
@@ -0,0 +1,346 @@
+package main
+
+import "fmt"
+import "sort"
+import "time"
+import "flag"
+import "errors"
+import "strings"
+import "strconv"
+import "net/url"
+import "encoding/hex"
+import "encoding/json"
+import . "github.com/nt1m/Peerster/types"
+
+type ReceivedMessage struct {
+  Origin string
+  ID uint32
+  Text string
+  Destination string
+  Channel string
+  Status string
+}
+
+type IndexedFile struct {
+  Name string
+  Hash string
+}
+
+type RegisteredName struct {
+  Name string
+  Size int64
+  Hash string
+}
+
+var errUsage = errors.New("invalid arguments, run with -help for usage")
+
+func runCommand(command string, args []string) error {
+  switch command {
+  case "send":
+    return sendCommand(args)
+  case "dm":
+    flags := flag.NewFlagSet("dm", flag.ExitOnError)
+    onion := flags.Bool("onion", false, "send over a circuit of relays")
+    flags.Parse(args)
+    if flags.NArg() < 2 {
+      return errUsage
+    }
+    return done(postMessage(&Message{Destination: flags.Arg(0), Text: strings.Join(flags.Args()[1:], " "), Onion: *onion}))
+  case "share":
+    if len(args) != 1 {
+      return errUsage
+    }
+    return done(postMessage(&Message{File: args[0]}))
+  case "download":
+    if len(args) == 2 && isMetaHash(args[0]) {
+      // The gossiper finds who holds it through the DHT
+      return done(postMessage(&Message{Request: args[0], File: args[1]}))
+    }
+    if len(args) == 2 {
+      // The gossiper resolves the name through the chain
+      return done(postMessage(&Message{Destination: args[0], File: args[1]}))
+    }
+    if len(args) != 3 {
+      return errUsage
+    }
+    return done(postMessage(&Message{Destination: args[0], Request: args[1], File: args[2]}))
+  case "search":
+    if len(args) != 1 {
+      return errUsage
+    }
+    return searchCommand(args[0])
+  case "peers":
+    return peersCommand(args)
+  case "routes":
+    return routesCommand()
+  case "files":
+    return filesCommand("")
+  case "downloads":
+    return downloadsCommand(args)
+  case "messages":
+    return messagesCommand(args)
+  case "channels":
+    return channelsCommand(args)
+  }
+  return fmt.Errorf("unknown command %q, run with -help for usage", command)
+}
+
+func isMetaHash(str string) bool {
+  decoded, err := hex.DecodeString(str)
+  return err == nil && len(decoded) == 32
+}
+
+// Reports the outcome of a command that has no result to print.
+func done(queued bool, err error) error {
+  if err != nil {
+    return err
+  }
+  if *jsonOutput {
+    fmt.Printf("{\"OK\":true,\"Queued\":%t}\n", queued)
+  } else if queued {
+    fmt.Println("QUEUED until a route to the destination is known or a download slot is free")
+  } else {
+    fmt.Println("OK")
+  }
+  return nil
+}
+
+func printJSON(v interface{}) error {
+  bytes, err := json.MarshalIndent(v, "", "  ")
+  if err != nil {
+    return err
+  }
+  fmt.Println(string(bytes))
+  return nil
+}
+
+func sendCommand(args []string) error {
+  flags := flag.NewFlagSet("send", flag.ExitOnError)
+  channel := flags.String("channel", "", "channel to post the message to")
+  flags.Parse(args)
+  if flags.NArg() == 0 {
+    return errUsage
+  }
+  return done(postMessage(&Message{Text: strings.Join(flags.Args(), " "), Channel: *channel}))
+}
+
+func peersCommand(args []string) error {
+  if len(args) == 2 && args[0] == "add" {
+    return done(apiRequest("POST", "/node", "text/plain", []byte(args[1])))
+  }
+  if len(args) >= 2 && len(args) <= 3 && args[0] == "ban" {
+    var duration int64
+    if len(args) == 3 {
+      seconds, err := time.ParseDuration(args[2])
+      if err != nil {
+        return err
+      }
+      duration = int64(seconds / time.Second)
+    }
+    body, _ := json.Marshal(map[string]interface{}{"Rule": args[1], "Duration": duration})
+    return done(apiRequest("POST", "/bans", "application/json", body))
+  }
+  if len(args) == 2 && args[0] == "unban" {
+    return done(apiRequest("DELETE", "/bans/" + url.PathEscape(args[1]), "text/plain", nil))
+  }
+  if len(args) == 1 && args[0] == "bans" {
+    return bansCommand()
+  }
+  if len(args) > 1 || len(args) == 1 && args[0] != "list" {
+    return errUsage
+  }
+  var peers []string
+  if err := apiGet("/node", &peers); err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(peers)
+  }
+  for _, peer := range peers {
+    fmt.Println(peer)
+  }
+  return nil
+}
+
+func bansCommand() error {
+  var bans []*BanInfo
+  if err := apiGet("/bans", &bans); err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(bans)
+  }
+  for _, b := range bans {
+    if b.Expires == 0 {
+      fmt.Println(b.Rule)
+    } else {
+      fmt.Println(b.Rule, "until", time.Unix(b.Expires, 0).Format(time.RFC3339))
+    }
+  }
+  return nil
+}
+
+func downloadsCommand(args []string) error {
+  if len(args) == 2 && (args[0] == "pause" || args[0] == "resume") {
+    return done(apiRequest("POST", "/downloads/" + url.PathEscape(args[1]) + "/" + args[0], "text/plain", nil))
+  }
+  if len(args) == 2 && args[0] == "cancel" {
+    return done(apiRequest("DELETE", "/downloads/" + url.PathEscape(args[1]), "text/plain", nil))
+  }
+  if len(args) == 3 && args[0] == "priority" {
+    priority, err := strconv.Atoi(args[2])
+    if err != nil {
+      return err
+    }
+    body, _ := json.Marshal(map[string]int{"Priority": priority})
+    return done(apiRequest("PUT", "/downloads/" + url.PathEscape(args[1]) + "/priority", "application/json", body))
+  }
+  if len(args) > 1 || len(args) == 1 && args[0] != "list" {
+    return errUsage
+  }
+  var downloads []*Download
+  if err := apiGet("/downloads", &downloads); err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(downloads)
+  }
+  for _, d := range downloads {
+    line := fmt.Sprintf("%s %-17s %d/%d chunks, priority %d, %s", d.Hash, d.State, d.Received, d.NumChunks, d.Priority, d.FileName)
+    if d.Error != "" {
+      line += " (" + d.Error + ")"
+    }
+    fmt.Println(line)
+  }
+  return nil
+}
+
+func routesCommand() error {
+  routes := make(map[string]string)
+  if err := apiGet("/route", &routes); err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(routes)
+  }
+  origins := make([]string, 0, len(routes))
+  for origin := range routes {
+    origins = append(origins, origin)
+  }
+  sort.Strings(origins)
+  for _, origin := range origins {
+    fmt.Printf("%-20s via %s\n", origin, routes[origin])
+  }
+  return nil
+}
+
+// Lists indexed files, keeping only the ones whose name contains keyword.
+func filesCommand(keyword string) error {
+  var files []*IndexedFile
+  if err := apiGet("/file", &files); err != nil {
+    return err
+  }
+  matching := make([]*IndexedFile, 0, len(files))
+  for _, file := range files {
+    if strings.Contains(strings.ToLower(file.Name), strings.ToLower(keyword)) {
+      matching = append(matching, file)
+    }
+  }
+  sort.Slice(matching, func(i, j int) bool { return matching[i].Name < matching[j].Name })
+  if *jsonOutput {
+    return printJSON(matching)
+  }
+  for _, file := range matching {
+    fmt.Println(file.Hash, file.Name)
+  }
+  return nil
+}
+
+// Lists the names registered on the chain that contain keyword.
+func searchCommand(keyword string) error {
+  var names []*RegisteredName
+  if err := apiGet("/name", &names); err != nil {
+    return err
+  }
+  matching := make([]*RegisteredName, 0, len(names))
+  for _, name := range names {
+    if strings.Contains(strings.ToLower(name.Name), strings.ToLower(keyword)) {
+      matching = append(matching, name)
+    }
+  }
+  sort.Slice(matching, func(i, j int) bool { return matching[i].Name < matching[j].Name })
+  if *jsonOutput {
+    return printJSON(matching)
+  }
+  for _, name := range matching {
+    fmt.Println(name.Hash, name.Name, name.Size, "bytes")
+  }
+  return nil
+}
+
+func printMessage(msg *ReceivedMessage) {
+  if *jsonOutput {
+    bytes, _ := json.Marshal(msg)
+    fmt.Println(string(bytes))
+    return
+  }
+  switch {
+  case msg.Destination != "" && msg.Status != "":
+    fmt.Printf("[%s -> %s] %s (%s)\n", msg.Origin, msg.Destination, msg.Text, msg.Status)
+  case msg.Destination != "":
+    fmt.Printf("[%s -> %s] %s\n", msg.Origin, msg.Destination, msg.Text)
+  case msg.Channel != "":
+    fmt.Printf("[%s #%s %d] %s\n", msg.Origin, msg.Channel, msg.ID, msg.Text)
+  default:
+    fmt.Printf("[%s %d] %s\n", msg.Origin, msg.ID, msg.Text)
+  }
+}
+
+func messagesCommand(args []string) error {
+  flags := flag.NewFlagSet("messages", flag.ExitOnError)
+  follow := flags.Bool("follow", false, "keep printing messages as they arrive")
+  flags.Parse(args)
+
+  printed := 0
+  for {
+    var messages []*ReceivedMessage
+    if err := apiGet("/message", &messages); err != nil {
+      return err
+    }
+    // The node restarted with fewer messages, start over
+    if printed > len(messages) {
+      printed = 0
+    }
+    for _, msg := range messages[printed:] {
+      printMessage(msg)
+    }
+    printed = len(messages)
+    if !*follow {
+      return nil
+    }
+    time.Sleep(time.Second)
+  }
+}
+
+func channelsCommand(args []string) error {
+  if len(args) == 2 && args[0] == "join" {
+    return done(apiRequest("POST", "/channel", "text/plain", []byte(args[1])))
+  }
+  if len(args) == 2 && args[0] == "leave" {
+    return done(apiRequest("DELETE", "/channel/" + url.PathEscape(args[1]), "text/plain", nil))
+  }
+  if len(args) > 1 || len(args) == 1 && args[0] != "list" {
+    return errUsage
+  }
+  var channels []string
+  if err := apiGet("/channel", &channels); err != nil {
+    return err
+  }
+  if *jsonOutput {
+    return printJSON(channels)
+  }
+  for _, channel := range channels {
+    fmt.Println("#" + channel)
+  }
+  return nil
+}
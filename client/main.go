@@ -1,34 +1,105 @@
 package main
 
-import _ "fmt"
+import "fmt"
+import "os"
 import "flag"
-import "net"
-import "github.com/dedis/protobuf"
-
-type Message struct {
-  Text string
-  Destination string
-  File string
-  Request string
+import "math/rand"
+import . "github.com/nt1m/Peerster/types"
+
+var (
+  UIPort = flag.String("UIPort", "8080",
+    "port for the UI client")
+  jsonOutput = flag.Bool("json", false,
+    "print command results as JSON")
+  node = flag.String("node", "",
+    "name of the node to talk to, when the process at UIPort hosts several")
+  token = flag.String("token", os.Getenv("PEERSTER_TOKEN"),
+    "token for the node's web server, if it requires one")
+  certFile = flag.String("cert", "",
+    "certificate of the node's web server, to talk to it over HTTPS")
+)
+
+func usage() {
+  fmt.Fprintln(os.Stderr, `Usage: client [-UIPort=8080] [-node=name] [-token=t] [-cert=file] [-json] <command> [arguments]
+
+Commands:
+  send [-channel=name] <text>        send a rumor to everyone or to a channel
+  dm [-onion] <destination> <text>   send a private message, over a circuit with -onion
+  share <file>                       index a file or directory of the shared directories
+  download <destination> <hash> <name>
+                                     download a file by metahash
+  download <destination> <name>      download a file registered on the chain
+  download <hash> <name>             download a file from holders found in the DHT
+  search <keyword>                   list registered names that match
+  peers list                         list direct peers
+  peers add <ip:port>                add a direct peer
+  peers ban <rule> [duration]        ban an address, CIDR or node name, e.g. for 1h
+  peers unban <rule>                 lift a ban
+  peers bans                         list bans in effect
+  routes                             list known origins and their next hop
+  files                              list indexed files
+  downloads [list]                   list downloads and their progress
+  downloads pause|resume|cancel <hash>
+                                     control a download
+  downloads priority <hash> <n>      start a queued download before lower ones
+  messages [-follow]                 print received messages
+  channels list|join|leave [name]    manage channel subscriptions
+
+Without a command, the legacy flags below send a single request over UDP:`)
+  flag.PrintDefaults()
 }
 
 func main() {
-  var UIPort = flag.String("UIPort", "8080",
-    "port for the UI client")
   var msgstr = flag.String("msg", "",
     "message to be sent")
   var dest = flag.String("dest", "",
     "destination for the private message")
   var file = flag.String("file", "", "file to be indexed by the gossiper")
   var request = flag.String("request", "", "request a chunk or metafile of this hash")
+  var channel = flag.String("channel", "", "channel to post the message to")
+  var join = flag.String("join", "", "channel to join or create")
+  var leave = flag.String("leave", "", "channel to leave")
+  flag.Usage = usage
   flag.Parse()
 
-  msg := Message{Text: *msgstr, Destination: *dest, File: *file, Request: *request}
-  packetBytes, err := protobuf.Encode(&msg)
-  checkError(err)
-  conn, err := net.Dial("udp4", "127.0.0.1:" + *UIPort)
+  if flag.NArg() > 0 {
+    if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+      fmt.Fprintln(os.Stderr, "error:", err)
+      os.Exit(1)
+    }
+    return
+  }
+
+  msg := Message{
+    Text: *msgstr,
+    Destination: *dest,
+    File: *file,
+    Request: *request,
+    Channel: *channel,
+    Join: *join,
+    Leave: *leave,
+  }
+  if *node != "" {
+    // Only the primary node listens on UIPort, reach the others through the web server
+    queued, err := postMessage(&msg)
+    if err != nil {
+      fmt.Fprintln(os.Stderr, "error:", err)
+      os.Exit(1)
+    }
+    if queued {
+      fmt.Println("QUEUED until a route to", msg.Destination, "is known")
+    }
+    return
+  }
+  reply, err := SendUIRequest("127.0.0.1:" + *UIPort, msg.ToUIRequest(rand.Uint32() | 1))
   checkError(err)
-  conn.Write(packetBytes)
+  if reply.Error != nil {
+    fmt.Fprintln(os.Stderr, "error:", reply.Error.Message)
+    os.Exit(1)
+  }
+  if reply.Queued {
+    fmt.Println("QUEUED until a route to", msg.Destination, "is known")
+  }
 }
 
 func checkError(err error) {
@@ -6,16 +6,25 @@ import (
   "time"
   "net"
   "os"
+  "strings"
+  "syscall"
+  "os/signal"
   "crypto/sha256"
+  "crypto/ed25519"
   "encoding/hex"
   "github.com/dedis/protobuf"
-  "github.com/nt1m/Peerster/utils"
   . "github.com/nt1m/Peerster/types"
   . "github.com/nt1m/Peerster/webserver"
 )
 
 type PacketResult struct {
-  packet *GossipPacket
+  packet *GossipPacket // nil if it couldn't be read, or was part of a link handshake
+  sender *net.UDPAddr
+  err *InvalidPacketError
+}
+
+type ClientRequest struct {
+  request *UIRequest // nil if it couldn't be decoded
   sender *net.UDPAddr
 }
 
@@ -32,110 +41,239 @@ var (
     "run gossiper in simple broadcast mode")
   rtimer = flag.Int("rtimer", 0,
     "route rumors sending period in seconds, 0 to disable sending of route rumors")
+  mailbox = flag.Bool("mailbox", false,
+    "hold private messages for unreachable destinations on behalf of peers")
+  naming = flag.String("naming", "blockchain",
+    "how file names are agreed on: blockchain (proof-of-work) or paxos (majority of -paxosMembers)")
+  paxosMembers = flag.String("paxosMembers", "",
+    "comma separated name=key members of paxos naming, keys being the hex Ed25519 keys they print at startup")
+  rate = flag.Int("rate", 0,
+    "outgoing bandwidth limit in bytes per second, 0 for unlimited")
+  peerRate = flag.Int("peerRate", 0,
+    "outgoing bandwidth limit per peer in bytes per second, 0 for unlimited")
+  requestRate = flag.Float64("requestRate", 100,
+    "requests per second a peer can make us answer, 0 for unlimited")
+  stateDir = flag.String("stateDir", "_State",
+    "directory where state and partial downloads are kept across restarts")
+  webAddr = flag.String("webAddr", "127.0.0.1",
+    "address the web server listens on")
+  adminToken = flag.String("adminToken", os.Getenv("PEERSTER_ADMIN_TOKEN"),
+    "token granting full access to the web server, generated if unset when -webAddr isn't loopback")
+  readToken = flag.String("readToken", os.Getenv("PEERSTER_READ_TOKEN"),
+    "token granting read-only access to the web server")
+  webTLS = flag.Bool("tls", false,
+    "serve the web server over HTTPS, with a self-signed certificate kept in -stateDir")
+  allow = flag.String("allow", "",
+    "comma separated addresses, CIDRs, node names or key:<hex Ed25519 key> that can become peers, anyone if empty. Names are only what joining nodes claim")
+  deny = flag.String("deny", "",
+    "comma separated addresses, CIDRs, node names or key:<hex Ed25519 key> whose packets are dropped. Names are only what nodes claim")
+  maxPerSubnet = flag.Int("maxPerSubnet", 0,
+    "peers accepted per subnet, 0 for unlimited")
+  subnetBits = flag.Int("subnetBits", 24,
+    "prefix length of the subnets counted by -maxPerSubnet")
+  joinDifficulty = flag.Uint("joinDifficulty", 0,
+    "leading zero bits of the proof of work new peers must send, 0 for none")
+  invitations = flag.String("invitations", "",
+    "comma separated tokens that each admit one new peer without proof of work")
+  invitation = flag.String("invitation", "",
+    "token presented to peers asking us to join")
+  linkPSK = flag.String("linkPSK", os.Getenv("PEERSTER_LINK_PSK"),
+    "network-wide pre-shared key authenticating every packet between neighbors")
+  onion = flag.Bool("onion", false,
+    "relay and receive onion-routed private messages, advertising an onion key in route rumors")
+  onionHops = flag.Int("onionHops", ONION_HOPS,
+    "relays in the circuits of onion-routed private messages, which wait until that many are known")
+  linkTrusted = flag.String("linkTrusted", "",
+    "comma separated hex Ed25519 keys of the neighbors allowed to handshake, enabling keypair authentication")
+  chunking = flag.String("chunking", "fixed",
+    "how shared files are split: fixed (8KB chunks) or cdc (content-defined, so edits keep most chunks)")
+  chunkMin = flag.Int("chunkMin", CDC_MIN_CHUNK_SIZE,
+    "minimum size of content-defined chunks")
+  chunkAvg = flag.Int("chunkAvg", CDC_AVG_CHUNK_SIZE,
+    "average size of content-defined chunks, rounded down to a power of two")
+  chunkMax = flag.Int("chunkMax", CDC_MAX_CHUNK_SIZE,
+    "maximum size of content-defined chunks")
+  sharedDirs = flag.String("sharedDirs", "_SharedFiles",
+    "comma separated directories whose files, subdirectories included, are shared by the first node, others share _SharedFiles in their state directory")
+  scanPeriod = flag.Int("scanPeriod", int(SHARED_SCAN_PERIOD / time.Second),
+    "seconds between scans of -sharedDirs for new, changed and deleted files, 0 to only share on request")
+  downloadDir = flag.String("downloadDir", DOWNLOAD_DIR,
+    "directory the first node writes downloaded files to, others write to _Downloads in their state directory")
+  maxDownloads = flag.Int("maxDownloads", MAX_ACTIVE_DOWNLOADS,
+    "downloads running at once, others wait in a queue")
+  downloadRetries = flag.Int("downloadRetries", DOWNLOAD_RETRIES,
+    "unanswered requests in a row, sent with exponential backoff, before a download fails")
 )
 
+var allowRules, denyRules []*PeerRule
+var paxosMemberKeys map[string]ed25519.PublicKey
+
 func main() {
   flag.Parse()
-
-  var rticker (<-chan time.Time)
-
-  clientChannel := make(chan Message)
-  localChannel := make(chan PacketResult)
-
-  antiEntropy := time.NewTicker(time.Second)
-  client := NewClient("127.0.0.1:" + *UIPort)
-  gossiper := NewGossiper(*gossipAddr, *name, *peers)
-
-  go NewWebServer(*UIPort, gossiper)
-
-  if !*simpleMode {
-    gossiper.SendRouteMessage()
+  if *naming != "blockchain" && *naming != "paxos" {
+    fmt.Println("Unknown naming", *naming)
+    os.Exit(1)
+  }
+  var err error
+  if *naming == "paxos" {
+    if paxosMemberKeys, err = ParsePaxosMembers(*paxosMembers); err != nil {
+      fmt.Println(err)
+      os.Exit(1)
+    }
+  }
+  if allowRules, err = ParsePeerRules(*allow); err == nil {
+    denyRules, err = ParsePeerRules(*deny)
+  }
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+  if *chunking != "fixed" && *chunking != "cdc" {
+    fmt.Println("Unknown chunking", *chunking)
+    os.Exit(1)
+  }
+  if err := ValidateChunkSizes(*chunkMin, *chunkAvg, *chunkMax); err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+  if *maxDownloads < 1 || *downloadRetries < 1 {
+    fmt.Println("-maxDownloads and -downloadRetries must be at least 1")
+    os.Exit(1)
+  }
+  if *joinDifficulty > uint(MAX_JOIN_DIFFICULTY) || *subnetBits < 1 || *subnetBits > 32 {
+    fmt.Println("-joinDifficulty must be at most", MAX_JOIN_DIFFICULTY, "and -subnetBits between 1 and 32")
+    os.Exit(1)
   }
 
-  go receiveClientMessage(client, clientChannel)
-  go receiveServerMessage(gossiper, localChannel)
-
-  if (*rtimer > 0) {
-    rticker = time.NewTicker(time.Duration(*rtimer) * time.Second).C
+  host := NewNodeHost()
+  if _, err := host.AddNode(&NodeConfig{Name: *name, GossipAddr: *gossipAddr, Peers: *peers}); err != nil {
+    fmt.Println(err)
+    os.Exit(1)
   }
+  web := &WebConfig{
+    BindAddr: *webAddr,
+    Port: *UIPort,
+    AdminToken: *adminToken,
+    ReadToken: *readToken,
+    TLS: *webTLS,
+    CertDir: *stateDir,
+  }
+  // Never expose the web server beyond this machine without authentication
+  if web.AdminToken == "" && !IsLoopback(web.BindAddr) {
+    web.AdminToken = RandomToken()
+    fmt.Println("WEB admin token", web.AdminToken)
+  }
+  go NewWebServer(web, host)
 
-  for {
-    select {
-    case msg := <-clientChannel:
-      go receiveClientMessage(client, clientChannel)
-      handleClientMessage(gossiper, client, &msg)
-      break
-    case received := <-localChannel:
-      go receiveServerMessage(gossiper, localChannel)
-      handleServerMessage(gossiper, received.packet, received.sender)
-      break
-    case <-antiEntropy.C:
-      go (func() {
-        random := gossiper.RandomPeer(gossiper.LastInteraction)
-        gossiper.SendPacket(random, &GossipPacket{nil, nil, gossiper.GetStatusPacket(), nil, nil, nil})
-        gossiper.LastInteraction = random
-      })()
-      break
-    case <-rticker:
-      go gossiper.SendRouteMessage()
-      break
-    }
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  <-signals
+
+  // Stop in order, so whatever can be saved or sent is
+  fmt.Println("SHUTTING DOWN")
+  host.RemoveAll()
+  if err := StopWebServer(time.Second); err != nil {
+    fmt.Println("Can't stop web server:", err)
   }
+  os.Exit(0)
 }
 
+var READ_ERROR_DELAY = 100 * time.Millisecond
+
 func receiveServerMessage(gossiper *Gossiper, c chan PacketResult) {
   packetBytes := make([]byte, 16384)
-  var packet GossipPacket
   n, sender, err := gossiper.Conn.ReadFromUDP(packetBytes)
-  utils.CheckError(err)
-  protobuf.Decode(packetBytes[:n], &packet)
-  c <- PacketResult{&packet, sender}
+  for err != nil {
+    if gossiper.IsStopping() {
+      return
+    }
+    // A failed read doesn't stop the node, only that read
+    fmt.Println("Can't read packet:", err)
+    time.Sleep(READ_ERROR_DELAY)
+    n, sender, err = gossiper.Conn.ReadFromUDP(packetBytes)
+  }
+  if gossiper.IsStopping() {
+    return
+  }
+  // Errors are counted by the main loop, so the reader doesn't stop
+  packet, invalid := gossiper.OpenPacket(packetBytes[:n], sender)
+  c <- PacketResult{packet, sender, invalid}
 }
 
-func receiveClientMessage(client *Client, c chan Message) {
+func receiveClientMessage(gossiper *Gossiper, client *Client, c chan ClientRequest) {
   buf := make([]byte, 16384)
-  var msg Message
+  var rq UIRequest
   fmt.Println("Waiting for client message...")
-  client.Conn.ReadFromUDP(buf)
-  protobuf.Decode(buf, &msg)
-  c <- msg
+  n, sender, err := client.Conn.ReadFromUDP(buf)
+  for err != nil {
+    if gossiper.IsStopping() {
+      return
+    }
+    fmt.Println("Can't read client message:", err)
+    time.Sleep(READ_ERROR_DELAY)
+    n, sender, err = client.Conn.ReadFromUDP(buf)
+  }
+  if gossiper.IsStopping() {
+    return
+  }
+  if err := protobuf.Decode(buf[:n], &rq); err != nil {
+    // Let the main loop reply, so the reader doesn't stop
+    c <- ClientRequest{nil, sender}
+    return
+  }
+  c <- ClientRequest{&rq, sender}
 }
 
 func handleServerMessage(gossiper *Gossiper, packet *GossipPacket, sender *net.UDPAddr) {
-  gossiper.AddPeer(sender)
+  if err := packet.Validate(); err != nil {
+    gossiper.RejectPacket(sender.String(), err)
+    return
+  }
+  if err := gossiper.AdmitPacket(packet, sender); err != nil {
+    gossiper.RejectPacket(sender.String(), err)
+    return
+  }
+  if packet.JoinChallenge != nil || packet.JoinRequest != nil {
+    return
+  }
+
+  if gossiper.IsRequest(packet) && !gossiper.AllowRequest(sender) {
+    fmt.Println("RATE LIMITED request from", sender.String())
+    return
+  }
 
   fmt.Println("PEERS", gossiper.PeersAsString())
   if packet.Simple != nil {
-    packet.Simple.RelayPeerAddr = sender.String()
-    packet.Simple.Log()
-    gossiper.ForwardToAllPeers(sender, packet)
+    gossiper.ReceiveSimple(packet.Simple, sender)
   }
 
   if packet.Rumor != nil {
-    gossiper.UpdateRoute(sender, packet.Rumor)
-    // Ignore message if arrived in non-linear order
-    if gossiper.ShouldIgnoreRumor(packet.Rumor) {
-      return
-    }
+    rm := packet.Rumor
+    gossiper.UpdateRoute(sender, rm)
 
-    packet.Rumor.Log(sender.String())
+    if gossiper.IsRumorAhead(rm) {
+      // Keep it until the gap is filled, and ask the sender for the missing ones
+      gossiper.BufferRumor(rm, sender)
+      gossiper.SendGapRequest(sender, rm.Origin, gossiper.MissingRumorIDs(rm.Origin, rm.ID))
+    } else {
+      rm.Log(sender.String())
 
-    // Forward the message if new
-    if gossiper.IsNewRumor(packet.Rumor) {
-      gossiper.RecordRumor(packet.Rumor)
-      // Exclude sender, as they just sent it to us.
-      gossiper.MongerRumor(packet.Rumor, sender, false)
+      // Forward the message if new, then the buffered ones now in sequence
+      if gossiper.IsNewRumor(rm) {
+        next, from := rm, sender
+        for next != nil {
+          gossiper.RecordRumor(next)
+          // Exclude sender, as they just sent it to us.
+          gossiper.MongerRumor(next, from, false)
+          if next, from = gossiper.NextPendingRumor(rm.Origin); next != nil {
+            next.Log(from.String())
+          }
+        }
+      }
     }
     gossiper.LastInteraction = sender
-    gossiper.LastRumor[sender.String()] = packet.Rumor
-    gossiper.SendPacket(sender, &GossipPacket{
-      nil,
-      nil,
-      gossiper.GetStatusPacket(),
-      nil,
-      nil,
-      nil,
-    })
+    gossiper.LastRumor[sender.String()] = rm
+    gossiper.SendPacket(sender, &GossipPacket{Status: gossiper.GetStatusPacket()})
   }
 
   if packet.Status != nil {
@@ -152,7 +290,7 @@ func handleServerMessage(gossiper *Gossiper, packet *GossipPacket, sender *net.U
       gossiper.MongerRumor(newMessage, nil, false)
     } else if gossiper.PeerHasRumors(packet.Status) {
       // Does peer have new messages ? Yes, notify the sender of status
-      gossiper.SendPacket(sender, &GossipPacket{nil, nil, gossiper.GetStatusPacket(), nil, nil, nil})
+      gossiper.SendPacket(sender, &GossipPacket{Status: gossiper.GetStatusPacket()})
     } else {
       fmt.Println("IN SYNC WITH", sender.String())
       // No, do a coin flip
@@ -160,23 +298,95 @@ func handleServerMessage(gossiper *Gossiper, packet *GossipPacket, sender *net.U
     }
   }
 
+  if packet.Gap != nil {
+    packet.Gap.Log(sender.String())
+    gossiper.ReplyGapRequest(sender, packet.Gap)
+  }
+
   if packet.Private != nil {
     pm := packet.Private
     if pm.Destination == gossiper.Name {
-      pm.Log()
-      gossiper.RecordPrivate(pm)
-    } else {
-      pm.HopLimit--
+      if gossiper.ReceivePrivate(pm) {
+        pm.Log()
+        gossiper.RecordPrivate(pm)
+      }
+    } else if DecrementHopLimit(&pm.HopLimit) {
       gossiper.ForwardPrivate(pm)
     }
   }
 
+  if packet.Onion != nil {
+    onion := packet.Onion
+    if onion.Destination == gossiper.Name {
+      if err := gossiper.ReceiveOnion(onion); err != nil {
+        fmt.Println("ONION dropped:", err)
+      }
+    } else if DecrementHopLimit(&onion.HopLimit) {
+      gossiper.ForwardOnion(onion)
+    }
+  }
+
+  if packet.PrivateAck != nil {
+    ack := packet.PrivateAck
+    if ack.Destination == gossiper.Name {
+      gossiper.ProcessPrivateAck(ack)
+    } else if DecrementHopLimit(&ack.HopLimit) {
+      gossiper.ForwardPrivateAck(ack)
+    }
+  }
+
+  if packet.Mail != nil {
+    mail := packet.Mail
+    if mail.Destination == gossiper.Name {
+      gossiper.ReceiveMail(mail)
+    } else if DecrementHopLimit(&mail.HopLimit) {
+      gossiper.ForwardMail(mail)
+    }
+  }
+
+  if packet.TxPublish != nil {
+    gossiper.ReceiveTransaction(packet.TxPublish, sender)
+  }
+
+  if packet.BlockPublish != nil {
+    gossiper.ReceiveBlock(packet.BlockPublish, sender)
+  }
+
+  if packet.BlockRequest != nil {
+    gossiper.ReplyBlockRequest(packet.BlockRequest, sender)
+  }
+
+  if packet.Paxos != nil {
+    gossiper.ReceivePaxos(packet.Paxos, sender)
+  }
+
+  if packet.DHT != nil {
+    gossiper.ReceiveDHTMessage(packet.DHT)
+  }
+
+  if packet.ChunkMapRequest != nil {
+    rq := packet.ChunkMapRequest
+    if rq.Destination == gossiper.Name {
+      gossiper.ReplyChunkMapRequest(rq)
+    } else if DecrementHopLimit(&rq.HopLimit) {
+      gossiper.SendChunkMapRequest(rq)
+    }
+  }
+
+  if packet.ChunkMapReply != nil {
+    rp := packet.ChunkMapReply
+    if rp.Destination == gossiper.Name {
+      gossiper.ProcessChunkMapReply(rp)
+    } else if DecrementHopLimit(&rp.HopLimit) {
+      gossiper.SendChunkMapReply(rp)
+    }
+  }
+
   if packet.DataRequest != nil {
     rq := packet.DataRequest
     if rq.Destination == gossiper.Name {
       gossiper.ReplyDataRequest(rq)
-    } else {
-      rq.HopLimit--
+    } else if DecrementHopLimit(&rq.HopLimit) {
       gossiper.ForwardDataRequest(rq)
     }
   }
@@ -185,82 +395,128 @@ func handleServerMessage(gossiper *Gossiper, packet *GossipPacket, sender *net.U
     rp := packet.DataReply
     if rp.Destination == gossiper.Name {
       gossiper.ProcessDataReply(rp)
-    } else {
-      rp.HopLimit--
+    } else if DecrementHopLimit(&rp.HopLimit) {
       gossiper.ForwardDataReply(rp)
     }
   }
 }
 
-func handleClientMessage(gossiper *Gossiper, client *Client, msg *Message) {
-  if msg.File != "" && msg.Request != "" {
-    requested, err := hex.DecodeString(msg.Request)
-    utils.CheckError(err)
-    gossiper.AddStubFile(msg.Request, requested, msg.File)
-    gossiper.SendDataRequest(&DataRequest{
-      Origin: gossiper.Name,
-      Destination: msg.Destination,
-      HopLimit: 10,
-      HashValue: requested,
+// Handles rq, and returns the reply or nil if respond will be called with it
+// later on the event loop.
+func handleClientMessage(gossiper *Gossiper, rq *UIRequest, respond func(*UIReply)) *UIReply {
+  reply := &UIReply{Version: UI_PROTOCOL_VERSION, ID: rq.ID}
+  if rq.Version != UI_PROTOCOL_VERSION {
+    reply.Error = NewUIError(UI_ERROR_UNSUPPORTED_VERSION, "protocol version %d is not supported", rq.Version)
+    return reply
+  }
+  if rq.CommandCount() != 1 {
+    reply.Error = NewUIError(UI_ERROR_BAD_REQUEST, "expected exactly one command")
+    return reply
+  }
+
+  switch {
+  case rq.Join != nil:
+    if !gossiper.JoinChannel(rq.Join.Channel) {
+      reply.Error = NewUIError(UI_ERROR_INVALID_CHANNEL, "invalid channel name %q", rq.Join.Channel)
+    }
+  case rq.Leave != nil:
+    gossiper.LeaveChannel(rq.Leave.Channel)
+  case rq.Download != nil:
+    reply.Queued, reply.Error = handleDownload(gossiper, rq.Download)
+  case rq.Share != nil:
+    indexFile(gossiper, rq.Share.File, func(err *UIError) {
+      reply.Error = err
+      respond(reply)
     })
-  } else if msg.File != "" {
-    file, err := os.Open("_SharedFiles/" + msg.File)
-    utils.CheckError(err)
-    fileStat, err := file.Stat()
-    utils.CheckError(err)
-    end := fileStat.Size()
-
-    numChunks := end / FILE_CHUNK_SIZE
-
-    chunks := make(map[string][]byte)
-    metaFile := make([]byte, 0, 32 * numChunks)
-    offset := int64(0)
-    for offset < end {
-      readLength := utils.Min(FILE_CHUNK_SIZE, end - offset)
-      chunk := make([]byte, readLength)
-      count, err := file.ReadAt(chunk, offset)
-      utils.CheckError(err)
-      chunkHash := sha256.Sum256(chunk)
-      chunks[hex.EncodeToString(chunkHash[:])] = chunk
-      metaFile = append(metaFile, chunkHash[:]...)
-      offset += int64(count)
+    return nil
+  case rq.Send != nil:
+    reply.Queued, reply.Error = handleSend(gossiper, rq.Send)
+  }
+  return reply
+}
+
+func handleDownload(gossiper *Gossiper, cmd *DownloadCommand) (bool, *UIError) {
+  // Directories are registered and requested with a trailing slash
+  directory := strings.HasSuffix(cmd.File, "/")
+  cmd.File = strings.TrimSuffix(cmd.File, "/")
+  if cmd.Request == "" {
+    var tx *TxPublish
+    if !directory {
+      tx = gossiper.ResolveName(cmd.File)
     }
-    metaHash := sha256.Sum256(metaFile)
-    gossiper.AddFile(msg.File, end, metaHash, metaFile, chunks, numChunks)
+    if tx == nil {
+      tx = gossiper.ResolveName(cmd.File + "/")
+      directory = tx != nil
+    }
+    if tx == nil {
+      return false, NewUIError(UI_ERROR_FILE_NOT_FOUND, "no file is registered as %s", cmd.File)
+    }
+    cmd.Request = hex.EncodeToString(tx.MetafileHash)
+  }
+  requested, err := hex.DecodeString(cmd.Request)
+  if err != nil || len(requested) != sha256.Size {
+    return false, NewUIError(UI_ERROR_BAD_REQUEST, "%q is not a valid metahash", cmd.Request)
   }
+  if err := SafePath(cmd.File); err != nil {
+    return false, NewUIError(UI_ERROR_BAD_REQUEST, "can't download as %s: %v", cmd.File, err)
+  }
+  if cmd.Destination == gossiper.Name {
+    return false, NewUIError(UI_ERROR_UNKNOWN_DESTINATION, "can't download %s from ourselves", cmd.File)
+  }
+  download := gossiper.QueueDownload(requested, cmd.File, cmd.Destination, 0, directory)
+  return download.State == DOWNLOAD_QUEUED || (cmd.Destination != "" && gossiper.Router[cmd.Destination] == nil), nil
+}
 
-  if msg.Destination != "" && msg.Text != "" {
-    privateMessage := &PrivateMessage{
-      Origin: gossiper.Name,
-      ID: 0,
-      Text: msg.Text,
-      Destination: msg.Destination,
-      HopLimit: 10,
+// Reads and hashes the file off the event loop, like scans do, then applies
+// the changes and calls done on it.
+func indexFile(gossiper *Gossiper, name string, done func(*UIError)) {
+  go func() {
+    changes, err := gossiper.Shares.Index(name)
+    gossiper.Post(func() {
+      if err != nil {
+        done(NewUIError(UI_ERROR_FILE_NOT_FOUND, "%v", err))
+        return
+      }
+      for _, change := range changes {
+        gossiper.ApplyShareChange(change)
+      }
+      done(nil)
+    })
+  }()
+}
+
+func handleSend(gossiper *Gossiper, cmd *SendCommand) (bool, *UIError) {
+  fmt.Println("CLIENT MESSAGE", cmd.Text)
+  if cmd.Text == "" {
+    return false, NewUIError(UI_ERROR_BAD_REQUEST, "empty message")
+  }
+
+  if cmd.Destination != "" {
+    if cmd.Destination == gossiper.Name {
+      return false, NewUIError(UI_ERROR_UNKNOWN_DESTINATION, "can't send a private message to ourselves")
     }
-    gossiper.RecordPrivate(privateMessage)
-    gossiper.ForwardPrivate(privateMessage)
-  } else if *simpleMode && msg.Text != "" {
-    packet := &GossipPacket{
-      &SimpleMessage{
-        gossiper.Name,
-        *gossipAddr,
-        msg.Text,
-      },
-      nil,
-      nil,
-      nil,
-      nil,
-      nil,
+    if cmd.Onion && !gossiper.CanOnion(cmd.Destination) {
+      return false, NewUIError(UI_ERROR_UNKNOWN_DESTINATION, "no onion key is known for %s", cmd.Destination)
+    }
+    // Circuits are built from known keys, they don't wait for a route
+    queued := !cmd.Onion && gossiper.Router[cmd.Destination] == nil
+    gossiper.SendPrivate(cmd.Text, cmd.Destination, cmd.Onion)
+    return queued, nil
+  } else if gossiper.SimpleMode {
+    gossiper.SendSimple(cmd.Text)
+  } else {
+    // Posting to a channel subscribes to it
+    if cmd.Channel != "" && !gossiper.JoinChannel(cmd.Channel) {
+      return false, NewUIError(UI_ERROR_INVALID_CHANNEL, "invalid channel name %q", cmd.Channel)
     }
-    gossiper.ForwardToAllPeers(gossiper.Address, packet)
-  } else if msg.Text != "" {
     rumor := &RumorMessage{
-      gossiper.Name,
-      gossiper.GetNextIDForOrigin(gossiper.Name),
-      msg.Text,
+      Origin: gossiper.Name,
+      ID: gossiper.GetNextIDForOrigin(gossiper.Name),
+      Text: cmd.Text,
+      Channel: cmd.Channel,
     }
     gossiper.RecordRumor(rumor)
     gossiper.MongerRumor(rumor, nil, false)
   }
-  fmt.Println("CLIENT MESSAGE", msg.Text)
+  return false, nil
 }
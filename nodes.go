@@ -0,0 +1,404 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "sort"
+  "sync"
+  "time"
+  "errors"
+  "strings"
+  "path/filepath"
+  "crypto/ed25519"
+  "encoding/hex"
+  . "github.com/nt1m/Peerster/types"
+  . "github.com/nt1m/Peerster/webserver"
+)
+
+var SHUTDOWN_DRAIN_TIMEOUT = 2 * time.Second
+
+// A gossiper hosted by this process, with its own UI socket and event loop.
+type Node struct {
+  gossiper *Gossiper
+  client *Client
+  stateDir string
+  stop chan bool
+  done chan bool // Closed once the node stopped
+}
+
+// Gossipers hosted by this process, by name. The first one added is the one
+// configured by the command line flags, and is served at the web server root.
+type NodeHost struct {
+  lock sync.Mutex
+  nodes map[string]*Node
+  primary *Node
+}
+
+func NewNodeHost() *NodeHost {
+  return &NodeHost{nodes: make(map[string]*Node)}
+}
+
+func (host *NodeHost) Primary() *Gossiper {
+  host.lock.Lock()
+  defer host.lock.Unlock()
+  return host.primary.gossiper
+}
+
+// Returns the gossiper of that name, or nil.
+func (host *NodeHost) Node(name string) *Gossiper {
+  host.lock.Lock()
+  defer host.lock.Unlock()
+  if node := host.nodes[name]; node != nil {
+    return node.gossiper
+  }
+  return nil
+}
+
+func (host *NodeHost) Names() []string {
+  host.lock.Lock()
+  defer host.lock.Unlock()
+  names := make([]string, 0, len(host.nodes))
+  for name := range host.nodes {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Starts a gossiper with the settings of the command line flags, but its own
+// name, address and peers.
+func (host *NodeHost) AddNode(config *NodeConfig) (*Gossiper, error) {
+  host.lock.Lock()
+  defer host.lock.Unlock()
+  if config.Name == "" || config.GossipAddr == "" {
+    return nil, errors.New("a node needs a name and a gossip address")
+  }
+  if host.nodes[config.Name] != nil {
+    return nil, fmt.Errorf("node %s already exists", config.Name)
+  }
+  for _, peer := range strings.Split(config.Peers, ",") {
+    if _, err := net.ResolveUDPAddr("udp4", peer); peer != "" && err != nil {
+      return nil, fmt.Errorf("invalid peer %q: %v", peer, err)
+    }
+  }
+
+  // Only the primary node listens on -UIPort, the others on any free port
+  uiAddress := "127.0.0.1:0"
+  if host.primary == nil {
+    uiAddress = "127.0.0.1:" + *UIPort
+  }
+  client := NewClient(uiAddress)
+  if client.Conn == nil {
+    return nil, fmt.Errorf("can't listen for UI requests on %s", uiAddress)
+  }
+  gossiper := NewGossiper(config.GossipAddr, config.Name, config.Peers)
+  if gossiper.Conn == nil {
+    client.Conn.Close()
+    return nil, fmt.Errorf("can't listen for gossip on %s", config.GossipAddr)
+  }
+  gossiper.UIAddress = client.Conn.LocalAddr().String()
+  gossiper.SimpleMode = *simpleMode
+  gossiper.IsMailbox = *mailbox
+  gossiper.Scheduler = NewSendScheduler(gossiper.Conn, *rate, *peerRate)
+  gossiper.RequestRate = *requestRate
+  gossiper.OnionHops = *onionHops
+  gossiper.MaxActiveDownloads, gossiper.DownloadRetries = *maxDownloads, *downloadRetries
+  gossiper.Policy.Allow = allowRules
+  gossiper.Policy.Deny = denyRules
+  gossiper.Policy.MaxPerSubnet = *maxPerSubnet
+  gossiper.Policy.SubnetBits = *subnetBits
+  gossiper.Policy.JoinDifficulty = uint32(*joinDifficulty)
+  for _, token := range strings.Split(*invitations, ",") {
+    if token != "" {
+      gossiper.Policy.Invitations[token] = true
+    }
+  }
+  gossiper.Policy.Invitation = *invitation
+
+  node := &Node{
+    gossiper: gossiper,
+    client: client,
+    stateDir: filepath.Join(*stateDir, config.Name),
+    stop: make(chan bool),
+    done: make(chan bool),
+  }
+  // Proven when joining peers, and signing paxos votes
+  identity, err := LoadOrCreateLinkIdentity(node.stateDir)
+  if err != nil {
+    gossiper.Conn.Close()
+    client.Conn.Close()
+    return nil, err
+  }
+  gossiper.Policy.Identity = identity
+  fmt.Println("IDENTITY public key", hex.EncodeToString(identity.Public().(ed25519.PublicKey)))
+  if *linkPSK != "" || *linkTrusted != "" {
+    if err := enableLinkAuth(gossiper, node.stateDir); err != nil {
+      gossiper.Conn.Close()
+      client.Conn.Close()
+      return nil, err
+    }
+  }
+  if *naming == "paxos" {
+    consensus, err := NewNameConsensus(paxosMemberKeys, config.Name, identity)
+    if err != nil {
+      gossiper.Conn.Close()
+      client.Conn.Close()
+      return nil, err
+    }
+    gossiper.Consensus = consensus
+  }
+  if *onion {
+    key, err := LoadOrCreateOnionKey(node.stateDir)
+    if err != nil {
+      gossiper.Conn.Close()
+      client.Conn.Close()
+      return nil, err
+    }
+    gossiper.OnionKey = key
+  }
+  mailKey, err := LoadOrCreateMailKey(node.stateDir)
+  if err != nil {
+    gossiper.Conn.Close()
+    client.Conn.Close()
+    return nil, err
+  }
+  gossiper.MailKey = mailKey
+  if err := gossiper.LoadState(node.stateDir); err != nil {
+    fmt.Println("Can't load state:", err)
+  }
+  if err := gossiper.LoadPartialDownloads(node.stateDir); err != nil {
+    fmt.Println("Can't load partial downloads:", err)
+  }
+  // Nodes hosted next to the first one keep their files apart from it
+  shared, downloads := strings.Split(*sharedDirs, ","), *downloadDir
+  if host.primary != nil {
+    shared = []string{filepath.Join(node.stateDir, "_SharedFiles")}
+    downloads = filepath.Join(node.stateDir, "_Downloads")
+  }
+  gossiper.DownloadDir = downloads
+  var sizes *ChunkSizes
+  if *chunking == "cdc" {
+    sizes = &ChunkSizes{Min: *chunkMin, Avg: *chunkAvg, Max: *chunkMax}
+  }
+  gossiper.Shares = NewShareWatcher(shared, sizes, node.stateDir)
+  gossiper.Shares.ScanPeriod = time.Duration(*scanPeriod) * time.Second
+  host.nodes[config.Name] = node
+  if host.primary == nil {
+    host.primary = node
+  }
+  go node.run()
+  fmt.Println("NODE", config.Name, "gossiping on", config.GossipAddr, "with UI on", gossiper.UIAddress)
+  return gossiper, nil
+}
+
+func enableLinkAuth(gossiper *Gossiper, stateDir string) error {
+  var identity ed25519.PrivateKey
+  var trusted []string
+  if *linkTrusted != "" {
+    var err error
+    if identity, err = LoadOrCreateLinkIdentity(stateDir); err != nil {
+      return err
+    }
+    trusted = strings.Split(*linkTrusted, ",")
+  }
+  auth, err := NewLinkAuth(*linkPSK, identity, trusted)
+  if err != nil {
+    return err
+  }
+  gossiper.EnableLinkAuth(auth)
+  if identity != nil {
+    fmt.Println("LINK public key", auth.PublicKey())
+  }
+  return nil
+}
+
+// Stops a node other than the primary one.
+func (host *NodeHost) RemoveNode(name string) error {
+  host.lock.Lock()
+  node := host.nodes[name]
+  if node == nil {
+    host.lock.Unlock()
+    return fmt.Errorf("no node is named %s", name)
+  }
+  if node == host.primary {
+    host.lock.Unlock()
+    return errors.New("the primary node can only be stopped with the process")
+  }
+  delete(host.nodes, name)
+  host.lock.Unlock()
+
+  close(node.stop)
+  <-node.done
+  return nil
+}
+
+// Stops every node, the primary one last.
+func (host *NodeHost) RemoveAll() {
+  host.lock.Lock()
+  nodes := host.nodes
+  host.nodes = make(map[string]*Node)
+  host.lock.Unlock()
+
+  for _, node := range nodes {
+    if node != host.primary {
+      close(node.stop)
+      <-node.done
+    }
+  }
+  if host.primary != nil {
+    close(host.primary.stop)
+    <-host.primary.done
+  }
+}
+
+func (node *Node) run() {
+  gossiper := node.gossiper
+  client := node.client
+
+  var rticker (<-chan time.Time)
+  var routeTicker *time.Ticker
+
+  clientChannel := make(chan ClientRequest)
+  localChannel := make(chan PacketResult)
+
+  antiEntropy := time.NewTicker(time.Second)
+  republish := time.NewTicker(PROVIDER_REPUBLISH)
+
+  if gossiper.Consensus == nil {
+    go gossiper.Mine()
+    for _, peer := range gossiper.Peers {
+      gossiper.RequestChainHead(peer)
+    }
+  }
+
+  if !gossiper.SimpleMode {
+    gossiper.SendRouteMessage()
+  }
+
+  go receiveClientMessage(gossiper, client, clientChannel)
+  go receiveServerMessage(gossiper, localChannel)
+  shareChannel := make(chan []*ShareChange)
+  if gossiper.Shares.ScanPeriod > 0 {
+    go watchShares(gossiper, shareChannel)
+  }
+
+  if (*rtimer > 0) {
+    routeTicker = time.NewTicker(time.Duration(*rtimer) * time.Second)
+    rticker = routeTicker.C
+  }
+
+  for {
+    select {
+    case received := <-clientChannel:
+      go receiveClientMessage(gossiper, client, clientChannel)
+      sender := received.sender
+      respond := func(reply *UIReply) {
+        if reply.Error != nil {
+          fmt.Println("CLIENT ERROR", reply.Error.Error())
+        }
+        client.Conn.WriteToUDP(EncodeUIReply(reply), sender)
+      }
+      reply := &UIReply{
+        Version: UI_PROTOCOL_VERSION,
+        Error: NewUIError(UI_ERROR_BAD_REQUEST, "malformed request"),
+      }
+      if received.request != nil {
+        reply = handleClientMessage(gossiper, received.request, respond)
+      }
+      if reply != nil {
+        respond(reply)
+      }
+      break
+    case received := <-localChannel:
+      go receiveServerMessage(gossiper, localChannel)
+      if received.err != nil {
+        gossiper.RejectPacket(received.sender.String(), received.err)
+      } else if received.packet != nil {
+        handleServerMessage(gossiper, received.packet, received.sender)
+      }
+      break
+    case <-antiEntropy.C:
+      go (func() {
+        if len(gossiper.Peers) == 0 {
+          return
+        }
+        random := gossiper.RandomPeer(gossiper.LastInteraction)
+        gossiper.SendPacket(random, &GossipPacket{Status: gossiper.GetStatusPacket()})
+        gossiper.LastInteraction = random
+      })()
+      break
+    case task := <-gossiper.Tasks:
+      task()
+      break
+    case changes := <-shareChannel:
+      for _, change := range changes {
+        gossiper.ApplyShareChange(change)
+      }
+      break
+    case <-rticker:
+      go gossiper.SendRouteMessage()
+      break
+    case <-republish.C:
+      gossiper.RepublishProviders()
+      break
+    case <-node.stop:
+      node.shutdown(antiEntropy, republish, routeTicker)
+      close(node.done)
+      return
+    }
+  }
+}
+
+// Scans the shared directories until the node stops. Files are read and
+// hashed here, the event loop only applies the changes.
+func watchShares(gossiper *Gossiper, changes chan []*ShareChange) {
+  for {
+    if found := gossiper.Shares.Scan(); len(found) > 0 {
+      select {
+      case changes <- found:
+      case <-gossiper.Quit:
+        return
+      }
+    }
+    select {
+    case <-time.After(gossiper.Shares.ScanPeriod):
+    case <-gossiper.Quit:
+      return
+    }
+  }
+}
+
+// Stops in order, so whatever can be saved or sent is.
+func (node *Node) shutdown(tickers ...*time.Ticker) {
+  gossiper := node.gossiper
+  for _, ticker := range tickers {
+    if ticker != nil {
+      ticker.Stop()
+    }
+  }
+  close(gossiper.Quit)
+  cancelled := gossiper.CancelTimeouts()
+  unsent := gossiper.Scheduler.Drain(SHUTDOWN_DRAIN_TIMEOUT)
+
+  if err := gossiper.SaveState(node.stateDir); err != nil {
+    fmt.Println("Can't save state:", err)
+  }
+  partials, err := gossiper.SavePartialDownloads(node.stateDir)
+  if err != nil {
+    fmt.Println("Can't save partial downloads:", err)
+  }
+  gossiper.Conn.Close()
+  node.client.Conn.Close()
+
+  rejected := uint64(0)
+  for _, count := range gossiper.Rejected {
+    rejected += count
+  }
+  rumors := 0
+  for _, messages := range gossiper.Rumors {
+    rumors += len(messages)
+  }
+  fmt.Println("SHUTDOWN", gossiper.Name, "knew", rumors, "rumors from", len(gossiper.Rumors), "origins,",
+    len(gossiper.Router), "routes,", len(gossiper.Files), "files;", partials, "partial downloads saved,",
+    cancelled, "timeouts cancelled,", unsent, "packets unsent,", gossiper.Scheduler.Dropped, "dropped,", rejected, "rejected")
+}
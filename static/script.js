@@ -53,6 +53,24 @@ function hashColor(str){
 }
 
 document.addEventListener("DOMContentLoaded", async () => {
+  $("#login-form").addEventListener("submit", async e => {
+    e.preventDefault();
+    const response = await login($("#login-token").value);
+    if (response.ok) {
+      location.reload();
+    } else {
+      $("#login-error").hidden = false;
+    }
+  });
+
+  const session = await getSession();
+  if (session.AuthEnabled && !session.Role) {
+    showLogin();
+    return;
+  }
+  // Read-only sessions can't send anything
+  document.body.classList.toggle("read-only", session.Role == "read");
+
   $("#node-id").textContent = await getNodeId();
 
   updateStatus();
@@ -60,7 +78,7 @@ document.addEventListener("DOMContentLoaded", async () => {
 
   $("#message-form").addEventListener("submit", e => {
     e.preventDefault();
-    sendMessage($("#send-input").value, $("#send-destination").value);
+    sendMessage($("#send-input").value, $("#send-destination").value, $("#send-onion").checked);
     $("#send-input").value = "";
   });
 
@@ -86,6 +104,18 @@ document.addEventListener("DOMContentLoaded", async () => {
     addPeer($("#add-peer-input").value);
     $("#add-peer-input").value = "";
   });
+
+  $("#join-channel-form").addEventListener("submit", async e => {
+    e.preventDefault();
+    await joinChannel($("#join-channel-input").value);
+    $("#join-channel-input").value = "";
+    updateStatus();
+  });
+
+  $("#channel-view-close").addEventListener("click", e => {
+    e.preventDefault();
+    $("#channel-view").hidden = true;
+  });
   setupTabComponent();
 });
 
@@ -116,50 +146,110 @@ async function updateStatus() {
     return li;
   }));
 
-  const messages = await getAllMessages();
-  $("#messages").append(...messages.slice(receivedMessages).map(({ Origin, ID, Text, Destination }) => {
+  const channels = await getAllChannels();
+  $("#node-channels").textContent = "";
+  $("#node-channels").append(...channels.map((c) => {
     const li = document.createElement("li");
-    li.classList.toggle("private", !!Destination);
-
-    const originEl = document.createElement("span");
-    originEl.textContent = Origin;
-    originEl.className = "message-origin";
 
-    const {background, textColor} = hashColor(Origin);
-    originEl.style.backgroundColor = background;
-    originEl.style.color = textColor;
+    const name = document.createElement("a");
+    name.className = "channel-name";
+    name.href = "#";
+    name.textContent = "#" + c;
+    name.addEventListener("click", e => {
+      e.preventDefault();
+      showChannelHistory(c);
+    });
+
+    const leave = document.createElement("button");
+    leave.className = "button channel-leave";
+    leave.title = "Leave channel";
+    leave.textContent = "×";
+    leave.addEventListener("click", async () => {
+      await leaveChannel(c);
+      updateStatus();
+    });
+
+    li.append(name, leave);
+    return li;
+  }));
 
-    const idEl = document.createElement("span");
-    if (!Destination) {
-      idEl.textContent = "Message " + ID;
-    } else if ($("#node-id").textContent != Destination) {
-      idEl.textContent = "Private message to " + Destination;
-    } else {
-      idEl.textContent = "Private message";
+  const messages = await getAllMessages();
+  $("#messages").append(...messages.slice(receivedMessages).map(createMessageElement));
+  // Delivery status of private messages changes after they were first shown
+  messages.forEach(({ Status }, i) => {
+    const statusEl = $(".message-status", $("#messages").children[i]);
+    if (statusEl) {
+      statusEl.textContent = Status;
     }
-    idEl.className = "message-id";
+  });
+  receivedMessages = messages.length;
 
-    const contentsEl = document.createElement("p");
-    contentsEl.textContent = Text;
-    contentsEl.className = "message-contents";
+  if (!$("#channel-view").hidden) {
+    await showChannelHistory($("#channel-view-name").dataset.channel);
+  }
 
-    li.append(originEl, idEl, contentsEl);
-    return li;
-  }));
-  receivedMessages = messages.length;
+  await updateDestinationSelect($("#send-destination"), true, channels)
+  await updateDestinationSelect($("#file-requestee"), false, [])
+}
+
+function createMessageElement({ Origin, ID, Text, Destination, Channel, Status }) {
+  const li = document.createElement("li");
+  li.classList.toggle("private", !!Destination);
+
+  const originEl = document.createElement("span");
+  originEl.textContent = Origin;
+  originEl.className = "message-origin";
+
+  const {background, textColor} = hashColor(Origin);
+  originEl.style.backgroundColor = background;
+  originEl.style.color = textColor;
+
+  const idEl = document.createElement("span");
+  if (Channel) {
+    idEl.textContent = "Message " + ID + " in #" + Channel;
+  } else if (!Destination) {
+    idEl.textContent = "Message " + ID;
+  } else if ($("#node-id").textContent != Destination) {
+    idEl.textContent = "Private message to " + Destination;
+  } else {
+    idEl.textContent = "Private message";
+  }
+  idEl.className = "message-id";
+
+  const contentsEl = document.createElement("p");
+  contentsEl.textContent = Text;
+  contentsEl.className = "message-contents";
+
+  li.append(originEl, idEl);
+  if (Status) {
+    const statusEl = document.createElement("span");
+    statusEl.textContent = Status;
+    statusEl.className = "message-status";
+    li.append(statusEl);
+  }
+  li.append(contentsEl);
+  return li;
+}
 
-  await updateDestinationSelect($("#send-destination"), true)
-  await updateDestinationSelect($("#file-requestee"), false)
+async function showChannelHistory(channel) {
+  const messages = await getChannelMessages(channel);
+  $("#channel-view-name").textContent = "#" + channel;
+  $("#channel-view-name").dataset.channel = channel;
+  $("#channel-messages").textContent = "";
+  $("#channel-messages").append(...messages.map(createMessageElement));
+  $("#channel-view").hidden = false;
 }
 
-async function updateDestinationSelect(select, includeEveryone) {
+// Channels are listed in the destination select with a "#" prefix
+async function updateDestinationSelect(select, includeEveryone, channels) {
   let destinations = await getAllDestinations();
   if (includeEveryone) {
     destinations = ["", ...destinations];
   }
+  destinations = [...destinations.sort((a,b) => a == "" ? -1 : a > b), ...channels.map(c => "#" + c)];
   const lastDestination = select.value;
   select.textContent = "";
-  select.append(...destinations.sort((a,b) => a == "" ? -1 : a > b).map(d => {
+  select.append(...destinations.map(d => {
     const option = document.createElement("option");
     option.value = d;
     option.textContent = d == "" ? "Everyone" : d;
@@ -168,41 +258,94 @@ async function updateDestinationSelect(select, includeEveryone) {
   select.value = destinations.includes(lastDestination) ? lastDestination : select.firstElementChild.value;
 }
 
+function csrfToken() {
+  const match = document.cookie.match(/(?:^|; )peerster_csrf=([^;]*)/);
+  return match ? decodeURIComponent(match[1]) : "";
+}
+
+function showLogin() {
+  $("#login-form").hidden = false;
+  $("#login-token").focus();
+}
+
+// Calls the API, asking to log in again when the session expired
+async function api(path, options = {}) {
+  const headers = new Headers(options.headers);
+  if (options.method && options.method != "GET") {
+    headers.append("X-CSRF-Token", csrfToken());
+  }
+  const response = await fetch(path, {...options, headers});
+  if (response.status == 401) {
+    showLogin();
+    throw new Error("authentication required");
+  }
+  return response;
+}
+
+async function getSession() {
+  const response = await fetch("/session");
+  return await response.json();
+}
+
+function login(token) {
+  const headers = new Headers();
+  headers.append("Content-Type", "application/json");
+
+  return fetch("/login", {
+    method: "POST",
+    headers,
+    body: JSON.stringify({Token: token}),
+  });
+}
+
 async function getNodeId() {
-  const response = await fetch("/id");
+  const response = await api("/id");
   return await response.text();
 }
 
 async function getAllPeers() {
-  const response = await fetch("/node");
+  const response = await api("/node");
   return JSON.parse(await response.text());
 }
 
 async function getAllFiles() {
-  const response = await fetch("/file");
+  const response = await api("/file");
   return JSON.parse(await response.text()).sort((a, b) => a.Name > b.Name);
 }
 
 async function getAllMessages() {
-  const response = await fetch("/message");
+  const response = await api("/message");
   return JSON.parse(await response.text());
 }
 
 async function getAllDestinations() {
-  const response = await fetch("/destination");
+  const response = await api("/destination");
   return [...JSON.parse(await response.text())];
 }
 
-function sendMessage(message, destination) {
+async function getAllChannels() {
+  const response = await api("/channel");
+  return JSON.parse(await response.text());
+}
+
+async function getChannelMessages(channel) {
+  const response = await api("/channel/" + encodeURIComponent(channel) + "/message");
+  return JSON.parse(await response.text());
+}
+
+function sendMessage(message, destination, onion) {
   const headers = new Headers();
   headers.append("Content-Type", "application/json");
 
-  return fetch("/message", {
+  const isChannel = destination.startsWith("#");
+  return api("/message", {
     method: "POST",
     headers,
     body: JSON.stringify({
       Text: message,
-      Destination: destination,
+      Destination: isChannel ? "" : destination,
+      Channel: isChannel ? destination.substring(1) : "",
+      Onion: onion && !isChannel && destination != "",
     }),
   });
 }
@@ -211,7 +354,7 @@ function sendUploadRequest(path) {
   const headers = new Headers();
   headers.append("Content-Type", "application/json");
 
-  return fetch("/message", {
+  return api("/message", {
     method: "POST",
     headers,
     body: JSON.stringify({
@@ -224,7 +367,7 @@ function sendDownloadRequest(destination, path, hash) {
   const headers = new Headers();
   headers.append("Content-Type", "application/json");
 
-  return fetch("/message", {
+  return api("/message", {
     method: "POST",
     headers,
     body: JSON.stringify({
@@ -235,11 +378,28 @@ function sendDownloadRequest(destination, path, hash) {
   });
 }
 
+function joinChannel(channel) {
+  const headers = new Headers();
+  headers.append("Content-Type", "text/plain");
+
+  return api("/channel", {
+    method: "POST",
+    headers,
+    body: channel,
+  });
+}
+
+function leaveChannel(channel) {
+  return api("/channel/" + encodeURIComponent(channel), {
+    method: "DELETE",
+  });
+}
+
 function addPeer(peerAddr) {
   const headers = new Headers();
   headers.append("Content-Type", "text/plain");
 
-  return fetch("/node", {
+  return api("/node", {
     method: "POST",
     headers,
     body: peerAddr,
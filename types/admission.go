@@ -0,0 +1,541 @@
+package types
+
+import (
+  "fmt"
+  "net"
+  "sort"
+  "time"
+  "strings"
+  "bytes"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "crypto/ed25519"
+  "encoding/hex"
+  "encoding/binary"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var JOIN_CHALLENGE_TTL = int64(60) // Seconds a challenge can be answered in, at least
+var MAX_JOIN_DIFFICULTY = uint32(28) // Leading zero bits, higher challenges are not answered
+var MAX_INVITATION_LENGTH = 64
+
+// Sent to an unknown address that must prove itself before it becomes a peer.
+type JoinChallenge struct {
+  Origin string
+  Challenge []byte // Bound to the address it was sent to
+  Difficulty uint32 // Leading zero bits of the proof of work, 0 if only invitations are accepted
+}
+
+// Answers a JoinChallenge with a proof of work, or with an invitation token.
+type JoinRequest struct {
+  Origin string
+  Challenge []byte
+  Nonce uint64
+  Invitation string
+  PublicKey []byte // Ed25519 identity of the origin, if it proves one
+  Signature []byte // Of the challenge and origin by PublicKey
+}
+
+// An address, an address without port, a CIDR, a node name, or key:<hex> for
+// an Ed25519 identity. Names are whatever joining nodes claim, so name rules
+// are advisory: only key rules identify a node wherever it connects from.
+type PeerRule struct {
+  Text string
+  Network *net.IPNet
+  Address string // ip:port, for rules on a single socket
+  Name string
+  Key ed25519.PublicKey // Proven by peers when they join
+}
+
+type ban struct {
+  rule *PeerRule
+  expires time.Time // Zero for bans that don't expire
+}
+
+// Who can become our peer. The zero policy admits everyone on their first
+// packet, as peers always were.
+type PeerPolicy struct {
+  Allow []*PeerRule // If any, peers must match one of them
+  Deny []*PeerRule
+  bans map[string]*ban // Map[Rule text -> Ban], set at runtime
+  MaxPerSubnet int // Peers per subnet, 0 for unlimited
+  SubnetBits int // Prefix length of a subnet
+  JoinDifficulty uint32 // Proof of work asked from new peers, 0 for none
+  Invitations map[string]bool // Tokens admitting new peers without proof of work, once each
+  Invitation string // Token we present when asked to join
+  Identity ed25519.PrivateKey // What we prove when asked to join, if set
+  keys map[string]ed25519.PublicKey // Map[Peer address -> Key it proved when joining]
+  secret []byte // Keys the challenges, so we don't have to remember them
+}
+
+func NewPeerPolicy() *PeerPolicy {
+  secret := make([]byte, 32)
+  rand.Read(secret)
+  return &PeerPolicy{
+    bans: make(map[string]*ban),
+    SubnetBits: 24,
+    Invitations: make(map[string]bool),
+    keys: make(map[string]ed25519.PublicKey),
+    secret: secret,
+  }
+}
+
+func ParsePeerRule(text string) (*PeerRule, error) {
+  text = strings.TrimSpace(text)
+  rule := &PeerRule{Text: text}
+  if text == "" {
+    return nil, fmt.Errorf("empty peer rule")
+  }
+  if strings.HasPrefix(text, "key:") {
+    key, err := hex.DecodeString(text[len("key:"):])
+    if err != nil || len(key) != ed25519.PublicKeySize {
+      return nil, fmt.Errorf("invalid key in peer rule %q", text)
+    }
+    rule.Key = key
+  } else if _, network, err := net.ParseCIDR(text); err == nil {
+    rule.Network = network
+  } else if ip := net.ParseIP(text); ip != nil {
+    rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(8 * len(ip), 8 * len(ip))}
+  } else if address, err := net.ResolveUDPAddr("udp4", text); err == nil && strings.Contains(text, ":") {
+    rule.Address = address.String()
+  } else if len(text) <= MAX_NAME_LENGTH && !strings.ContainsAny(text, ":/ ") {
+    rule.Name = text
+  } else {
+    return nil, fmt.Errorf("invalid peer rule %q", text)
+  }
+  return rule, nil
+}
+
+// Parses a comma separated list of rules.
+func ParsePeerRules(list string) ([]*PeerRule, error) {
+  var rules []*PeerRule
+  for _, text := range strings.Split(list, ",") {
+    if strings.TrimSpace(text) == "" {
+      continue
+    }
+    rule, err := ParsePeerRule(text)
+    if err != nil {
+      return nil, err
+    }
+    rules = append(rules, rule)
+  }
+  return rules, nil
+}
+
+// Whether the rule matches that address, name or key, any of which may be unknown.
+func (rule *PeerRule) Matches(address *net.UDPAddr, name string, key ed25519.PublicKey) bool {
+  switch {
+  case rule.Network != nil:
+    return address != nil && rule.Network.Contains(address.IP)
+  case rule.Address != "":
+    return address != nil && rule.Address == address.String()
+  case rule.Key != nil:
+    return key != nil && bytes.Equal(rule.Key, key)
+  }
+  return name != "" && rule.Name == name
+}
+
+func matchesAny(rules []*PeerRule, address *net.UDPAddr, name string, key ed25519.PublicKey) bool {
+  for _, rule := range rules {
+    if rule.Matches(address, name, key) {
+      return true
+    }
+  }
+  return false
+}
+
+// Whether some rules are about who a node says it is, which it has to tell
+// by joining.
+func hasIdentityRules(rules []*PeerRule) bool {
+  for _, rule := range rules {
+    if rule.Name != "" || rule.Key != nil {
+      return true
+    }
+  }
+  return false
+}
+
+// The key the peer at that address proved when it joined, if any.
+func (policy *PeerPolicy) keyOf(address *net.UDPAddr) ed25519.PublicKey {
+  if address == nil {
+    return nil
+  }
+  return policy.keys[address.String()]
+}
+
+// Whether the address, name or key is denied or banned. The key the address
+// proved when joining is checked too.
+func (policy *PeerPolicy) IsDenied(address *net.UDPAddr, name string, key ed25519.PublicKey) bool {
+  proven := policy.keyOf(address)
+  matches := func(rule *PeerRule) bool {
+    return rule.Matches(address, name, key) || proven != nil && rule.Matches(address, name, proven)
+  }
+  for _, rule := range policy.Deny {
+    if matches(rule) {
+      return true
+    }
+  }
+  for text, b := range policy.bans {
+    if !b.expires.IsZero() && time.Now().After(b.expires) {
+      delete(policy.bans, text)
+    } else if matches(b.rule) {
+      return true
+    }
+  }
+  return false
+}
+
+// Whether new peers have to introduce themselves, with a name, a key, a proof
+// of work or an invitation.
+func (policy *PeerPolicy) RequiresJoin() bool {
+  return policy.JoinDifficulty > 0 || len(policy.Invitations) > 0 || hasIdentityRules(policy.Allow)
+}
+
+// Whether the address can become a peer without telling who it is.
+func (policy *PeerPolicy) AdmitsWithoutJoin(address *net.UDPAddr) bool {
+  return !policy.IsDenied(address, "", nil) && !policy.RequiresJoin() &&
+    (len(policy.Allow) == 0 || matchesAny(policy.Allow, address, "", nil))
+}
+
+// Challenges are keyed by our secret, the address and the current period, so
+// they expire and can't be reused from another address.
+func (policy *PeerPolicy) challengeFor(address *net.UDPAddr, period int64) []byte {
+  hash := sha256.New()
+  hash.Write(policy.secret)
+  hash.Write([]byte(address.String()))
+  binary.Write(hash, binary.BigEndian, period)
+  return hash.Sum(nil)
+}
+
+func (policy *PeerPolicy) NewChallenge(address *net.UDPAddr) []byte {
+  return policy.challengeFor(address, time.Now().Unix() / JOIN_CHALLENGE_TTL)
+}
+
+func (policy *PeerPolicy) isValidChallenge(address *net.UDPAddr, challenge []byte) bool {
+  period := time.Now().Unix() / JOIN_CHALLENGE_TTL
+  return subtle.ConstantTimeCompare(challenge, policy.challengeFor(address, period)) == 1 ||
+    subtle.ConstantTimeCompare(challenge, policy.challengeFor(address, period - 1)) == 1
+}
+
+// What a joining node signs to prove its key, bound to the challenge and so
+// to the address it joins from.
+func joinTranscript(challenge []byte, origin string) []byte {
+  return append(append([]byte("peerster join"), challenge...), origin...)
+}
+
+func joinProof(challenge []byte, origin string, nonce uint64) [32]byte {
+  data := make([]byte, len(challenge) + len(origin) + 8)
+  copy(data, challenge)
+  copy(data[len(challenge):], origin)
+  binary.BigEndian.PutUint64(data[len(challenge) + len(origin):], nonce)
+  return sha256.Sum256(data)
+}
+
+func leadingZeroBits(hash []byte) uint32 {
+  bits := uint32(0)
+  for _, b := range hash {
+    if b != 0 {
+      for b & 0x80 == 0 {
+        bits++
+        b <<= 1
+      }
+      return bits
+    }
+    bits += 8
+  }
+  return bits
+}
+
+// Finds a nonce whose proof has difficulty leading zero bits.
+func SolveJoinChallenge(challenge []byte, origin string, difficulty uint32) uint64 {
+  for nonce := uint64(0); ; nonce++ {
+    proof := joinProof(challenge, origin, nonce)
+    if leadingZeroBits(proof[:]) >= difficulty {
+      return nonce
+    }
+  }
+}
+
+// Number of peers in the same subnet as address.
+func (gossiper *Gossiper) peersInSubnet(address *net.UDPAddr) int {
+  ip := address.IP
+  bits := gossiper.Policy.SubnetBits
+  if ip4 := ip.To4(); ip4 != nil {
+    ip = ip4
+  } else {
+    bits += 96
+  }
+  mask := net.CIDRMask(bits, 8 * len(ip))
+  subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+  count := 0
+  for _, peer := range gossiper.Peers {
+    if subnet.Contains(peer.IP) {
+      count++
+    }
+  }
+  return count
+}
+
+func (gossiper *Gossiper) isPeer(address *net.UDPAddr) bool {
+  for _, peer := range gossiper.Peers {
+    if peer.String() == address.String() {
+      return true
+    }
+  }
+  return false
+}
+
+// The node a packet claims to come from, if its variant names one.
+func (packet *GossipPacket) OriginName() string {
+  switch {
+  case packet.Simple != nil:
+    return packet.Simple.OriginalName
+  case packet.Rumor != nil:
+    return packet.Rumor.Origin
+  case packet.Private != nil:
+    return packet.Private.Origin
+  case packet.DataRequest != nil:
+    return packet.DataRequest.Origin
+  case packet.DataReply != nil:
+    return packet.DataReply.Origin
+  case packet.Gap != nil:
+    return packet.Gap.Origin
+  case packet.PrivateAck != nil:
+    return packet.PrivateAck.Origin
+  case packet.Paxos != nil:
+    return packet.Paxos.Origin
+  case packet.DHT != nil:
+    return packet.DHT.Origin
+  case packet.ChunkMapRequest != nil:
+    return packet.ChunkMapRequest.Origin
+  case packet.ChunkMapReply != nil:
+    return packet.ChunkMapReply.Origin
+  case packet.JoinChallenge != nil:
+    return packet.JoinChallenge.Origin
+  case packet.JoinRequest != nil:
+    return packet.JoinRequest.Origin
+  }
+  return ""
+}
+
+// Decides whether a validated packet is processed, adding its sender as a
+// peer if it may become one. Unknown senders that have to join are sent a
+// challenge, and their packets dropped until they answer it.
+func (gossiper *Gossiper) AdmitPacket(packet *GossipPacket, sender *net.UDPAddr) *InvalidPacketError {
+  policy := gossiper.Policy
+  if policy.IsDenied(sender, packet.OriginName(), nil) {
+    return invalid("denied", "%s is denied", packet.OriginName())
+  }
+  if packet.JoinChallenge != nil {
+    gossiper.AnswerJoinChallenge(packet.JoinChallenge, sender)
+    return nil
+  }
+  if gossiper.isPeer(sender) {
+    return nil
+  }
+
+  if len(policy.Allow) > 0 && !hasIdentityRules(policy.Allow) && !matchesAny(policy.Allow, sender, "", nil) {
+    return invalid("denied", "%s is not allowed", sender.String())
+  }
+  if policy.MaxPerSubnet > 0 && gossiper.peersInSubnet(sender) >= policy.MaxPerSubnet {
+    return invalid("denied", "subnet of %s already has %d peers", sender.String(), policy.MaxPerSubnet)
+  }
+  if !policy.RequiresJoin() {
+    gossiper.addNeighbor(sender)
+    return nil
+  }
+  if packet.JoinRequest == nil {
+    gossiper.SendPacket(sender, &GossipPacket{JoinChallenge: &JoinChallenge{
+      Origin: gossiper.Name,
+      Challenge: policy.NewChallenge(sender),
+      Difficulty: policy.JoinDifficulty,
+    }})
+    return invalid("join", "%s has to join first", sender.String())
+  }
+  if err := gossiper.checkJoinRequest(packet.JoinRequest, sender); err != nil {
+    return err
+  }
+  if key := packet.JoinRequest.PublicKey; key != nil {
+    policy.keys[sender.String()] = key
+  }
+  gossiper.addNeighbor(sender)
+  fmt.Println("JOINED by", packet.JoinRequest.Origin, "at", sender.String())
+  return nil
+}
+
+// Adds a peer that reached us, and asks for its chain, which may have blocks
+// we missed.
+func (gossiper *Gossiper) addNeighbor(sender *net.UDPAddr) {
+  gossiper.AddPeer(sender)
+  if gossiper.Consensus == nil {
+    gossiper.RequestChainHead(sender)
+  }
+}
+
+func (gossiper *Gossiper) checkJoinRequest(rq *JoinRequest, sender *net.UDPAddr) *InvalidPacketError {
+  policy := gossiper.Policy
+  if !policy.isValidChallenge(sender, rq.Challenge) {
+    return invalid("join", "challenge expired or issued to another address")
+  }
+  var key ed25519.PublicKey
+  if rq.PublicKey != nil {
+    if !ed25519.Verify(rq.PublicKey, joinTranscript(rq.Challenge, rq.Origin), rq.Signature) {
+      return invalid("join", "bad signature by the key of %s", rq.Origin)
+    }
+    key = rq.PublicKey
+  }
+  if policy.IsDenied(sender, rq.Origin, key) {
+    return invalid("denied", "%s is denied", rq.Origin)
+  }
+  if len(policy.Allow) > 0 && !matchesAny(policy.Allow, sender, rq.Origin, key) {
+    return invalid("denied", "%s at %s is not allowed", rq.Origin, sender.String())
+  }
+  if rq.Invitation != "" {
+    for token := range policy.Invitations {
+      if subtle.ConstantTimeCompare([]byte(token), []byte(rq.Invitation)) == 1 {
+        delete(policy.Invitations, token)
+        return nil
+      }
+    }
+    return invalid("join", "unknown invitation")
+  }
+  if policy.JoinDifficulty > 0 {
+    proof := joinProof(rq.Challenge, rq.Origin, rq.Nonce)
+    if leadingZeroBits(proof[:]) < policy.JoinDifficulty {
+      return invalid("join", "proof of work is below %d bits", policy.JoinDifficulty)
+    }
+    return nil
+  }
+  if len(policy.Invitations) > 0 {
+    return invalid("join", "an invitation is required")
+  }
+  // Only a name or key is required
+  return nil
+}
+
+// Proves ourselves to a peer we want to talk to. Challenges from anyone else
+// are ignored, so we can't be made to work for arbitrary addresses.
+func (gossiper *Gossiper) AnswerJoinChallenge(challenge *JoinChallenge, sender *net.UDPAddr) {
+  if !gossiper.isPeer(sender) || challenge.Difficulty > MAX_JOIN_DIFFICULTY {
+    return
+  }
+  key := sender.String()
+  if gossiper.Joining[key] {
+    return
+  }
+  gossiper.Joining[key] = true
+  fmt.Println("JOINING", challenge.Origin, "at", key, "difficulty", challenge.Difficulty)
+
+  rq := &JoinRequest{
+    Origin: gossiper.Name,
+    Challenge: challenge.Challenge,
+    Invitation: gossiper.Policy.Invitation,
+  }
+  if identity := gossiper.Policy.Identity; identity != nil {
+    rq.PublicKey = identity.Public().(ed25519.PublicKey)
+    rq.Signature = ed25519.Sign(identity, joinTranscript(rq.Challenge, rq.Origin))
+  }
+  // Only the proof of work is done off the event loop
+  go (func() {
+    if rq.Invitation == "" && challenge.Difficulty > 0 {
+      rq.Nonce = SolveJoinChallenge(rq.Challenge, rq.Origin, challenge.Difficulty)
+    }
+    gossiper.Post(func() {
+      gossiper.SendPacket(sender, &GossipPacket{JoinRequest: rq})
+      // Allow answering a later challenge, should this answer be lost
+      utils.SetTimeout(func() {
+        gossiper.Post(func() {
+          delete(gossiper.Joining, key)
+        })
+      }, time.Second)
+    })
+  })()
+}
+
+// Bans peers matching the rule, for duration or forever if 0, and forgets
+// them and the routes through them.
+func (gossiper *Gossiper) Ban(text string, duration time.Duration) error {
+  rule, err := ParsePeerRule(text)
+  if err != nil {
+    return err
+  }
+  b := &ban{rule: rule}
+  if duration > 0 {
+    b.expires = time.Now().Add(duration)
+  }
+  gossiper.Policy.bans[rule.Text] = b
+
+  policy := gossiper.Policy
+  peers := gossiper.Peers[:0]
+  for _, peer := range gossiper.Peers {
+    if !rule.Matches(peer, "", policy.keyOf(peer)) {
+      peers = append(peers, peer)
+    }
+  }
+  gossiper.Peers = peers
+  for origin, address := range gossiper.Router {
+    if rule.Matches(address, origin, policy.keyOf(address)) {
+      delete(gossiper.Router, origin)
+    }
+  }
+  if gossiper.LastInteraction != nil && rule.Matches(gossiper.LastInteraction, "", policy.keyOf(gossiper.LastInteraction)) {
+    gossiper.LastInteraction = nil
+  }
+  fmt.Println("BANNED", rule.Text)
+  return nil
+}
+
+// Lifts a ban, returns false if there was none.
+func (gossiper *Gossiper) Unban(text string) bool {
+  text = strings.TrimSpace(text)
+  if gossiper.Policy.bans[text] == nil {
+    return false
+  }
+  delete(gossiper.Policy.bans, text)
+  fmt.Println("UNBANNED", text)
+  return true
+}
+
+type BanInfo struct {
+  Rule string
+  Expires int64 // Unix time, 0 for bans that don't expire
+}
+
+// Bans in effect, sorted by rule.
+func (gossiper *Gossiper) Bans() []*BanInfo {
+  list := make([]*BanInfo, 0, len(gossiper.Policy.bans))
+  for text, b := range gossiper.Policy.bans {
+    if !b.expires.IsZero() && time.Now().After(b.expires) {
+      delete(gossiper.Policy.bans, text)
+      continue
+    }
+    info := &BanInfo{Rule: text}
+    if !b.expires.IsZero() {
+      info.Expires = b.expires.Unix()
+    }
+    list = append(list, info)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Rule < list[j].Rule })
+  return list
+}
+
+func validateJoin(packet *GossipPacket) *InvalidPacketError {
+  if packet.JoinChallenge != nil {
+    challenge := packet.JoinChallenge
+    return firstError(
+      checkName("JoinChallenge", "Origin", challenge.Origin),
+      checkHash("JoinChallenge", "Challenge", challenge.Challenge))
+  }
+  rq := packet.JoinRequest
+  if len(rq.Invitation) > MAX_INVITATION_LENGTH {
+    return invalid("JoinRequest", "invitation is longer than %d bytes", MAX_INVITATION_LENGTH)
+  }
+  if rq.PublicKey != nil && len(rq.PublicKey) != ed25519.PublicKeySize ||
+    rq.PublicKey == nil && rq.Signature != nil {
+    return invalid("JoinRequest", "malformed public key")
+  }
+  return firstError(
+    checkName("JoinRequest", "Origin", rq.Origin),
+    checkHash("JoinRequest", "Challenge", rq.Challenge))
+}
@@ -0,0 +1,466 @@
+package types
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "bytes"
+  "math/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/binary"
+  "github.com/dedis/protobuf"
+)
+
+var MINING_DIFFICULTY_BITS = 16
+var MAX_BLOCK_SIZE = MAX_PACKET_SIZE - 1024 // Encoded transactions, leaving room for the rest of the packet
+var MAX_PENDING_TRANSACTIONS = 4 * MAX_BLOCK_TRANSACTIONS
+var MAX_ORPHAN_BLOCKS = 64 // The oldest are evicted first
+var TX_HOP_LIMIT = uint32(10)
+var BLOCK_HOP_LIMIT = uint32(20)
+
+// Claims that Name refers to the file with the given metahash
+type TxPublish struct {
+  Name string
+  Size int64
+  MetafileHash []byte
+  HopLimit uint32
+}
+
+type Block struct {
+  PrevHash [32]byte
+  Nonce [32]byte
+  Transactions []TxPublish
+}
+
+type BlockPublish struct {
+  Block Block
+  HopLimit uint32
+}
+
+// Asks a neighbor for the block of that hash, or for its head if Hash is
+// empty. The block is sent back with a hop limit of 1, so it isn't forwarded.
+type BlockRequest struct {
+  Hash []byte
+}
+
+type chainBlock struct {
+  block *Block
+  height int
+}
+
+type orphanBlock struct {
+  hash [32]byte
+  block *Block
+}
+
+// Agreed name registry, kept as the longest chain of proof-of-work blocks.
+// The miner runs concurrently with the gossiper, hence the lock.
+type Blockchain struct {
+  lock sync.Mutex
+  blocks map[[32]byte]*chainBlock // Map[Hash -> Block], all branches
+  orphans []orphanBlock // Waiting for their parent, oldest first
+  head [32]byte
+  height int
+  pending []*TxPublish
+  names map[string]*TxPublish // Names claimed in the longest chain
+}
+
+func NewBlockchain() *Blockchain {
+  return &Blockchain{
+    blocks: make(map[[32]byte]*chainBlock),
+    names: make(map[string]*TxPublish),
+  }
+}
+
+func (tx *TxPublish) Hash() (out [32]byte) {
+  h := sha256.New()
+  binary.Write(h, binary.LittleEndian, uint32(len(tx.Name)))
+  h.Write([]byte(tx.Name))
+  binary.Write(h, binary.LittleEndian, tx.Size)
+  h.Write(tx.MetafileHash)
+  copy(out[:], h.Sum(nil))
+  return
+}
+
+func (b *Block) Hash() (out [32]byte) {
+  h := sha256.New()
+  h.Write(b.PrevHash[:])
+  h.Write(b.Nonce[:])
+  binary.Write(h, binary.LittleEndian, uint32(len(b.Transactions)))
+  for _, tx := range b.Transactions {
+    txHash := tx.Hash()
+    h.Write(txHash[:])
+  }
+  copy(out[:], h.Sum(nil))
+  return
+}
+
+func HasProofOfWork(hash [32]byte) bool {
+  for bit := 0; bit < MINING_DIFFICULTY_BITS; bit++ {
+    if hash[bit / 8] & (0x80 >> uint(bit % 8)) != 0 {
+      return false
+    }
+  }
+  return true
+}
+
+// Names claimed on the chain ending at hash.
+func (chain *Blockchain) namesAt(hash [32]byte) map[string]*TxPublish {
+  names := make(map[string]*TxPublish)
+  for current := chain.blocks[hash]; current != nil; current = chain.blocks[current.block.PrevHash] {
+    for i := range current.block.Transactions {
+      tx := &current.block.Transactions[i]
+      names[tx.Name] = tx
+    }
+  }
+  return names
+}
+
+func (chain *Blockchain) isPending(name string) bool {
+  for _, tx := range chain.pending {
+    if tx.Name == name {
+      return true
+    }
+  }
+  return false
+}
+
+// Adds a transaction to the ones to mine, returns false if its name is
+// already claimed or too many are waiting.
+func (chain *Blockchain) AddTransaction(tx *TxPublish) bool {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  if tx.Name == "" || len(tx.MetafileHash) != sha256.Size || chain.names[tx.Name] != nil || chain.isPending(tx.Name) ||
+    len(chain.pending) >= MAX_PENDING_TRANSACTIONS {
+    return false
+  }
+  chain.pending = append(chain.pending, tx)
+  return true
+}
+
+// Adds a block to the tree of known blocks, switching to its branch if it
+// becomes the longest. Returns false if the block is invalid or already known.
+func (chain *Blockchain) AddBlock(block *Block) bool {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  return chain.addBlock(block)
+}
+
+func (chain *Blockchain) addBlock(block *Block) bool {
+  hash := block.Hash()
+  if chain.blocks[hash] != nil || !HasProofOfWork(hash) {
+    return false
+  }
+
+  height := 1
+  if block.PrevHash != ([32]byte{}) {
+    parent := chain.blocks[block.PrevHash]
+    if parent == nil {
+      chain.addOrphan(hash, block)
+      return false
+    }
+    height = parent.height + 1
+  }
+
+  // Names can only be claimed once along a chain
+  names := chain.namesAt(block.PrevHash)
+  for i := range block.Transactions {
+    tx := &block.Transactions[i]
+    if names[tx.Name] != nil {
+      fmt.Println("INVALID block", hex.EncodeToString(hash[:]), "claims", tx.Name, "again")
+      return false
+    }
+    names[tx.Name] = tx
+  }
+  chain.blocks[hash] = &chainBlock{block, height}
+
+  if height > chain.height {
+    oldNames := chain.names
+    if block.PrevHash != chain.head && chain.height > 0 {
+      fmt.Println("FORK-LONGER rewind", chain.rewindLength(block.PrevHash), "blocks")
+    }
+    chain.head = hash
+    chain.height = height
+    chain.names = chain.namesAt(hash)
+    // Claims of the abandoned branch get mined again
+    for name, tx := range oldNames {
+      if chain.names[name] == nil && !chain.isPending(name) && len(chain.pending) < MAX_PENDING_TRANSACTIONS {
+        chain.pending = append(chain.pending, tx)
+      }
+    }
+    chain.prunePending()
+    chain.Log()
+  } else {
+    fmt.Println("FORK-SHORTER", hex.EncodeToString(hash[:]))
+  }
+
+  // Blocks that were waiting for this one
+  var adopted []*Block
+  kept := chain.orphans[:0]
+  for _, orphan := range chain.orphans {
+    if orphan.block.PrevHash == hash {
+      adopted = append(adopted, orphan.block)
+    } else {
+      kept = append(kept, orphan)
+    }
+  }
+  chain.orphans = kept
+  for _, orphan := range adopted {
+    chain.addBlock(orphan)
+  }
+  return true
+}
+
+func (chain *Blockchain) orphan(hash [32]byte) *Block {
+  for _, orphan := range chain.orphans {
+    if orphan.hash == hash {
+      return orphan.block
+    }
+  }
+  return nil
+}
+
+// Keeps a block until its parent arrives, evicting the oldest orphan if there
+// are too many.
+func (chain *Blockchain) addOrphan(hash [32]byte, block *Block) {
+  if chain.orphan(hash) != nil {
+    return
+  }
+  if len(chain.orphans) >= MAX_ORPHAN_BLOCKS {
+    chain.orphans = append(chain.orphans[:0], chain.orphans[1:]...)
+  }
+  chain.orphans = append(chain.orphans, orphanBlock{hash, block})
+}
+
+// The first block missing from the branch of the orphan of that hash, if it
+// is one.
+func (chain *Blockchain) MissingAncestor(hash [32]byte) ([32]byte, bool) {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  for {
+    orphan := chain.orphan(hash)
+    if orphan == nil {
+      return hash, false
+    }
+    hash = orphan.PrevHash
+    if chain.blocks[hash] == nil && chain.orphan(hash) == nil {
+      return hash, true
+    }
+  }
+}
+
+// The block of that hash, or the head if hash is zero. Nil if there is none.
+func (chain *Blockchain) Block(hash [32]byte) *Block {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  if hash == ([32]byte{}) {
+    hash = chain.head
+  }
+  if current := chain.blocks[hash]; current != nil {
+    return current.block
+  }
+  return nil
+}
+
+// Number of blocks of the current chain that are not ancestors of hash.
+func (chain *Blockchain) rewindLength(hash [32]byte) int {
+  ancestors := make(map[[32]byte]bool)
+  for current := chain.blocks[hash]; current != nil; current = chain.blocks[current.block.PrevHash] {
+    ancestors[current.block.Hash()] = true
+  }
+  count := 0
+  for current := chain.blocks[chain.head]; current != nil && !ancestors[current.block.Hash()]; current = chain.blocks[current.block.PrevHash] {
+    count++
+  }
+  return count
+}
+
+// Drops the pending transactions whose names got claimed by the chain.
+func (chain *Blockchain) prunePending() {
+  var kept []*TxPublish
+  for _, tx := range chain.pending {
+    if chain.names[tx.Name] == nil {
+      kept = append(kept, tx)
+    }
+  }
+  chain.pending = kept
+}
+
+func (chain *Blockchain) ResolveName(name string) *TxPublish {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  return chain.names[name]
+}
+
+func (chain *Blockchain) Names() []*TxPublish {
+  chain.lock.Lock()
+  defer chain.lock.Unlock()
+  list := make([]*TxPublish, 0, len(chain.names))
+  for _, tx := range chain.names {
+    list = append(list, tx)
+  }
+  return list
+}
+
+func (chain *Blockchain) Log() {
+  str := ""
+  for current := chain.blocks[chain.head]; current != nil; current = chain.blocks[current.block.PrevHash] {
+    hash := current.block.Hash()
+    str += " " + hex.EncodeToString(hash[:]) + ":" + hex.EncodeToString(current.block.PrevHash[:]) + ":"
+    for i, tx := range current.block.Transactions {
+      if i > 0 {
+        str += ","
+      }
+      str += tx.Name
+    }
+  }
+  fmt.Println("CHAIN" + str)
+}
+
+// Tries nonces for a block extending the current head, giving up after
+// attempts. Blocks take the oldest pending transactions that fit in a packet,
+// the others wait for the next blocks.
+func (chain *Blockchain) tryMining(attempts int) *Block {
+  chain.lock.Lock()
+  if len(chain.pending) == 0 {
+    chain.lock.Unlock()
+    return nil
+  }
+  block := &Block{PrevHash: chain.head}
+  size := 0
+  for _, tx := range chain.pending {
+    encoded, err := protobuf.Encode(tx)
+    if err != nil {
+      continue
+    }
+    // With the field's tag and length
+    if len(block.Transactions) == MAX_BLOCK_TRANSACTIONS || size + len(encoded) + 4 > MAX_BLOCK_SIZE {
+      break
+    }
+    size += len(encoded) + 4
+    block.Transactions = append(block.Transactions, *tx)
+  }
+  chain.lock.Unlock()
+
+  for i := 0; i < attempts; i++ {
+    rand.Read(block.Nonce[:])
+    if HasProofOfWork(block.Hash()) {
+      return block
+    }
+  }
+  return nil
+}
+
+// Mines blocks out of pending transactions until shutdown. Blocks found are
+// added and published to our peers by the event loop.
+func (gossiper *Gossiper) Mine() {
+  for !gossiper.IsStopping() {
+    block := gossiper.Chain.tryMining(10000)
+    if block == nil {
+      time.Sleep(100 * time.Millisecond)
+      continue
+    }
+    // Mine on top of it only once it is added
+    added := make(chan bool, 1)
+    gossiper.Post(func() {
+      gossiper.publishMinedBlock(block)
+      added <- true
+    })
+    select {
+    case <-added:
+    case <-gossiper.Quit:
+      return
+    }
+  }
+}
+
+func (gossiper *Gossiper) publishMinedBlock(block *Block) {
+  hash := block.Hash()
+  if gossiper.Chain.AddBlock(block) {
+    fmt.Println("FOUND-BLOCK", hex.EncodeToString(hash[:]))
+    gossiper.ForwardToAllPeers(nil, &GossipPacket{BlockPublish: &BlockPublish{
+      Block: *block,
+      HopLimit: BLOCK_HOP_LIMIT,
+    }})
+  }
+}
+
+func (gossiper *Gossiper) ResolveName(name string) *TxPublish {
+  if gossiper.Consensus != nil {
+    return gossiper.Consensus.ResolveName(name)
+  }
+  return gossiper.Chain.ResolveName(name)
+}
+
+func (gossiper *Gossiper) RegisteredNames() []*TxPublish {
+  if gossiper.Consensus != nil {
+    return gossiper.Consensus.Names()
+  }
+  return gossiper.Chain.Names()
+}
+
+// Claims name for a file we indexed, unless it's already registered.
+func (gossiper *Gossiper) PublishName(name string, size int64, metaHash []byte) {
+  if tx := gossiper.ResolveName(name); tx != nil {
+    if !bytes.Equal(tx.MetafileHash, metaHash) {
+      fmt.Println("NAME", name, "is already claimed by", hex.EncodeToString(tx.MetafileHash))
+    }
+    return
+  }
+  tx := &TxPublish{
+    Name: name,
+    Size: size,
+    MetafileHash: metaHash,
+    HopLimit: TX_HOP_LIMIT,
+  }
+  if gossiper.Consensus != nil {
+    gossiper.ProposeName(tx)
+  } else if gossiper.Chain.AddTransaction(tx) {
+    gossiper.ForwardToAllPeers(nil, &GossipPacket{TxPublish: tx})
+  }
+}
+
+func (gossiper *Gossiper) ReceiveTransaction(tx *TxPublish, sender *net.UDPAddr) {
+  if !gossiper.Chain.AddTransaction(tx) || tx.HopLimit <= 1 {
+    return
+  }
+  forwarded := *tx
+  forwarded.HopLimit--
+  gossiper.ForwardToAllPeers(sender, &GossipPacket{TxPublish: &forwarded})
+}
+
+func (gossiper *Gossiper) ReceiveBlock(bp *BlockPublish, sender *net.UDPAddr) {
+  if !gossiper.Chain.AddBlock(&bp.Block) {
+    // The sender holds the blocks it extends
+    if missing, ok := gossiper.Chain.MissingAncestor(bp.Block.Hash()); ok {
+      gossiper.SendPacket(sender, &GossipPacket{BlockRequest: &BlockRequest{Hash: missing[:]}})
+    }
+    return
+  }
+  if bp.HopLimit <= 1 {
+    return
+  }
+  gossiper.ForwardToAllPeers(sender, &GossipPacket{BlockPublish: &BlockPublish{
+    Block: bp.Block,
+    HopLimit: bp.HopLimit - 1,
+  }})
+}
+
+// Asks peer for its head, so nodes that missed blocks catch up without
+// waiting for the next one.
+func (gossiper *Gossiper) RequestChainHead(peer *net.UDPAddr) {
+  gossiper.SendPacket(peer, &GossipPacket{BlockRequest: &BlockRequest{}})
+}
+
+func (gossiper *Gossiper) ReplyBlockRequest(rq *BlockRequest, sender *net.UDPAddr) {
+  var hash [32]byte
+  copy(hash[:], rq.Hash)
+  if block := gossiper.Chain.Block(hash); block != nil {
+    gossiper.SendPacket(sender, &GossipPacket{BlockPublish: &BlockPublish{
+      Block: *block,
+      HopLimit: 1,
+    }})
+  }
+}
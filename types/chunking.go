@@ -0,0 +1,113 @@
+package types
+
+import (
+  "fmt"
+  "math/bits"
+  "encoding/hex"
+  "encoding/binary"
+  "crypto/sha256"
+)
+
+// Default content-defined chunk sizes, in bytes.
+var CDC_MIN_CHUNK_SIZE = 2048
+var CDC_AVG_CHUNK_SIZE = 8192
+var CDC_MAX_CHUNK_SIZE = 12288
+var MAX_CHUNK_SIZE = 14 * 1024 // A chunk must fit in one DataReply
+
+// Content-defined chunk sizes, in bytes. Boundaries depend on the data, so an
+// insertion only changes the chunks around it and the rest are shared.
+type ChunkSizes struct {
+  Min int
+  Avg int
+  Max int
+}
+
+// Gear hash values of each byte. Derived rather than random, so every node
+// cuts the same data at the same places.
+var gearTable = makeGearTable()
+
+func makeGearTable() [256]uint64 {
+  var table [256]uint64
+  for i := range table {
+    hash := sha256.Sum256([]byte{byte(i)})
+    table[i] = binary.BigEndian.Uint64(hash[:8])
+  }
+  return table
+}
+
+func ValidateChunkSizes(min, avg, max int) error {
+  if min < 1 || avg < min || max < avg || max > MAX_CHUNK_SIZE {
+    return fmt.Errorf("chunk sizes must satisfy 1 <= min <= avg <= max <= %d", MAX_CHUNK_SIZE)
+  }
+  return nil
+}
+
+// Splits data into FILE_CHUNK_SIZE chunks, or content-defined ones of those
+// sizes if set.
+func SplitChunks(data []byte, sizes *ChunkSizes) [][]byte {
+  var chunks [][]byte
+  for len(data) > 0 {
+    end := int(FILE_CHUNK_SIZE)
+    if sizes != nil {
+      end = sizes.nextBoundary(data)
+    }
+    if end > len(data) {
+      end = len(data)
+    }
+    chunks = append(chunks, data[:end])
+    data = data[end:]
+  }
+  return chunks
+}
+
+// Length of the first content-defined chunk of data. Cuts where the top bits
+// of a rolling gear hash over the last 64 bytes are all zero, which happens
+// every Avg bytes on average past the minimum.
+func (sizes *ChunkSizes) nextBoundary(data []byte) int {
+  if len(data) <= sizes.Min {
+    return len(data)
+  }
+  maskBits := bits.Len(uint(sizes.Avg)) - 1
+  mask := ^uint64(0) << (64 - maskBits)
+  end := sizes.Max
+  if end > len(data) {
+    end = len(data)
+  }
+  hash := uint64(0)
+  for i := sizes.Min; i < end; i++ {
+    hash = hash << 1 + gearTable[data[i]]
+    if hash & mask == 0 {
+      return i + 1
+    }
+  }
+  return end
+}
+
+// Keeps one copy of a chunk shared by several files, and returns it.
+func (gossiper *Gossiper) StoreChunk(key string, data []byte) []byte {
+  if stored := gossiper.ChunkStore[key]; len(stored) > 0 {
+    return stored
+  }
+  gossiper.ChunkStore[key] = data
+  return data
+}
+
+// Fills the chunks of file we already hold for another file, then skips past
+// them, so they are never transferred again. Returns how many were filled.
+func (gossiper *Gossiper) FillStoredChunks(file *File) int {
+  filled := 0
+  for key, data := range file.Chunks {
+    if len(data) == 0 && len(gossiper.ChunkStore[key]) > 0 {
+      file.Chunks[key] = gossiper.ChunkStore[key]
+      filled++
+    }
+  }
+  for file.Status < file.NumChunks {
+    offset := file.Status * 32
+    if len(file.Chunks[hex.EncodeToString(file.MetaFile[offset:offset + 32])]) == 0 {
+      break
+    }
+    file.Status++
+  }
+  return filled
+}
@@ -0,0 +1,112 @@
+package types
+
+import (
+  "fmt"
+  "math/rand"
+  "encoding/hex"
+)
+
+func HasChunk(bitmap []byte, index int) bool {
+  return index >= 0 && index / 8 < len(bitmap) && bitmap[index / 8] & (0x80 >> uint(index % 8)) != 0
+}
+
+// Chunks of the file we hold, in metafile order.
+func (file *File) ChunkBitmap() []byte {
+  if file.MetaFile == nil {
+    return []byte{}
+  }
+  numChunks := len(file.MetaFile) / 32
+  bitmap := make([]byte, (numChunks + 7) / 8)
+  for i := 0; i < numChunks; i++ {
+    if len(file.Chunks[hex.EncodeToString(file.MetaFile[i * 32:(i + 1) * 32])]) > 0 {
+      bitmap[i / 8] |= 0x80 >> uint(i % 8)
+    }
+  }
+  return bitmap
+}
+
+// Asks the providers of a file we started downloading which chunks they hold,
+// except source.
+func (gossiper *Gossiper) DiscoverChunkHolders(file *File, source string) {
+  metaHash := file.MetaHash
+  gossiper.FindProviders(metaHash, func(providers []string) {
+    for _, provider := range providers {
+      if provider == source {
+        continue
+      }
+      gossiper.SendChunkMapRequest(&ChunkMapRequest{
+        Origin: gossiper.Name,
+        Destination: provider,
+        HopLimit: 10,
+        MetaHash: metaHash,
+      })
+    }
+  })
+}
+
+// Picks a peer known to hold chunk index of file, or fallback if none is and
+// its bitmap, if we have one, doesn't say it lacks the chunk. Empty if no
+// peer can serve it.
+func (gossiper *Gossiper) ChunkSource(file *File, index int, fallback string) string {
+  var holders []string
+  bitmaps := gossiper.PeerChunkMaps[hex.EncodeToString(file.MetaHash)]
+  for origin, bitmap := range bitmaps {
+    if HasChunk(bitmap, index) && gossiper.Router[origin] != nil {
+      holders = append(holders, origin)
+    }
+  }
+  if len(holders) > 0 {
+    return holders[rand.Intn(len(holders))]
+  }
+  if bitmap, ok := bitmaps[fallback]; ok && !HasChunk(bitmap, index) {
+    return ""
+  }
+  return fallback
+}
+
+// Forgets what origin said it holds of the file of that metahash, until it
+// tells us again.
+func (gossiper *Gossiper) forgetChunkMap(key, origin string) {
+  delete(gossiper.PeerChunkMaps[key], origin)
+}
+
+func (gossiper *Gossiper) SendChunkMapRequest(rq *ChunkMapRequest) {
+  if rq.HopLimit == 0 || gossiper.Router[rq.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[rq.Destination], &GossipPacket{ChunkMapRequest: rq})
+}
+
+func (gossiper *Gossiper) SendChunkMapReply(rp *ChunkMapReply) {
+  if rp.HopLimit == 0 || gossiper.Router[rp.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[rp.Destination], &GossipPacket{ChunkMapReply: rp})
+}
+
+func (gossiper *Gossiper) ReplyChunkMapRequest(rq *ChunkMapRequest) {
+  file := gossiper.Files[hex.EncodeToString(rq.MetaHash)]
+  if file == nil || file.MetaFile == nil {
+    return
+  }
+  gossiper.SendChunkMapReply(&ChunkMapReply{
+    Origin: gossiper.Name,
+    Destination: rq.Origin,
+    HopLimit: 10,
+    MetaHash: rq.MetaHash,
+    NumChunks: uint32(len(file.MetaFile) / 32),
+    Bitmap: file.ChunkBitmap(),
+  })
+}
+
+func (gossiper *Gossiper) ProcessChunkMapReply(rp *ChunkMapReply) {
+  key := hex.EncodeToString(rp.MetaHash)
+  if gossiper.Files[key] == nil {
+    return
+  }
+  if gossiper.PeerChunkMaps[key] == nil {
+    gossiper.PeerChunkMaps[key] = make(map[string][]byte)
+  }
+  gossiper.PeerChunkMaps[key][rp.Origin] = rp.Bitmap
+  fmt.Println("CHUNK MAP of", gossiper.Files[key].FileName, "from", rp.Origin)
+}
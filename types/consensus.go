@@ -0,0 +1,534 @@
+package types
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+  "strconv"
+  "crypto/sha256"
+  "crypto/ed25519"
+  "encoding/hex"
+  "encoding/binary"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var PAXOS_HOP_LIMIT = uint32(10)
+var PAXOS_TIMEOUT = 5 * time.Second // For a ballot to gather a majority
+var PAXOS_MAX_ATTEMPTS = 3 // Ballots opened per claim before it fails
+var MAX_PAXOS_SEEN = 4096 // Flooded messages remembered, to forward them once
+var MAX_PAXOS_VOTES = 256
+
+const (
+  PAXOS_PROPOSE = uint32(1) // Asks to accept a claim in a ballot
+  PAXOS_ACCEPT = uint32(2) // Signed vote for the claim of a ballot
+  PAXOS_COMMIT = uint32(3) // Carries the votes of a majority for a claim
+  PAXOS_PREPARE = uint32(4) // Opens a ballot
+  PAXOS_PROMISE = uint32(5) // Signed answer to a prepare, with the claim accepted before if any
+)
+
+// Prepares, proposals and commits are flooded to everyone, promises and
+// accepts are routed back to the proposer, as are the commits sent to
+// proposers of names already committed. A ballot is a Round and a Proposer,
+// so two proposers never open the same one.
+type PaxosMessage struct {
+  Type uint32
+  Origin string
+  Destination string // Proposer, for promises, accepts and routed commits
+  Proposer string
+  Round uint32
+  Claim TxPublish // For promises, the claim accepted before if AcceptedRound is set
+  AcceptedRound uint32 // For promises, ballot of the claim the origin accepted last, 0 if none
+  AcceptedProposer string
+  Signature []byte // Of the origin, for promises and accepts
+  Votes []PaxosVote // For commits
+  HopLimit uint32
+}
+
+// A member's signed accept of the claim of a ballot.
+type PaxosVote struct {
+  Origin string
+  Signature []byte
+}
+
+type paxosBallot struct {
+  round uint32
+  proposer string
+}
+
+func (b paxosBallot) less(other paxosBallot) bool {
+  return b.round < other.round || b.round == other.round && b.proposer < other.proposer
+}
+
+// What a member promised and accepted for a name.
+type acceptorState struct {
+  promised paxosBallot
+  accepted paxosBallot
+  claim *TxPublish // Accepted in the accepted ballot, nil if none
+}
+
+// One of our claims, through the ballots opened for it.
+type proposal struct {
+  claim *TxPublish
+  ballot paxosBallot
+  value *TxPublish // Proposed in the ballot: our claim, or one a majority may already have accepted
+  highest paxosBallot // Of the claims promises reported as accepted
+  promises map[string]bool
+  votes map[string][]byte // Map[Member -> Signature of its accept]
+  proposing bool // Past the prepare phase
+  seenRound uint32 // Highest round other ballots for the name use
+  attempts int
+  timeout chan bool
+}
+
+// Name registry where a claim becomes final once a majority of the members
+// accepted it in the same ballot, following paxos for each name. Members are
+// known by their Ed25519 keys, so only they can vote, and a commit carries
+// their votes so anyone can check it.
+type NameConsensus struct {
+  Nodes int
+  members map[string]ed25519.PublicKey
+  identity ed25519.PrivateKey // Signs our votes, if we are a member
+  acceptors map[string]*acceptorState // Map[Name -> Our votes as a member]
+  committed map[string]*TxPublish
+  commits map[string]*PaxosMessage // Map[Name -> Commit that made it final], for those who missed it
+  log []*TxPublish // Committed claims, in the order we learned them
+  proposals map[string]*proposal // Our own claims, by name
+  seen map[string]bool
+  seenOrder []string // Same keys, oldest first, to bound the cache
+}
+
+// Parses comma separated name=key members, keys being hex encoded Ed25519 public keys.
+func ParsePaxosMembers(str string) (map[string]ed25519.PublicKey, error) {
+  members := make(map[string]ed25519.PublicKey)
+  for _, member := range strings.Split(str, ",") {
+    if member = strings.TrimSpace(member); member == "" {
+      continue
+    }
+    parts := strings.SplitN(member, "=", 2)
+    if len(parts) != 2 || parts[0] == "" {
+      return nil, fmt.Errorf("invalid paxos member %q, expected name=key", member)
+    }
+    key, err := hex.DecodeString(parts[1])
+    if err != nil || len(key) != ed25519.PublicKeySize {
+      return nil, fmt.Errorf("invalid key for paxos member %s", parts[0])
+    }
+    if members[parts[0]] != nil {
+      return nil, fmt.Errorf("paxos member %s is listed twice", parts[0])
+    }
+    members[parts[0]] = key
+  }
+  if len(members) == 0 {
+    return nil, errors.New("paxos naming needs members")
+  }
+  return members, nil
+}
+
+// A registry agreed on by members, in which we vote with identity if name is
+// one of them.
+func NewNameConsensus(members map[string]ed25519.PublicKey, name string, identity ed25519.PrivateKey) (*NameConsensus, error) {
+  consensus := &NameConsensus{
+    Nodes: len(members),
+    members: members,
+    acceptors: make(map[string]*acceptorState),
+    committed: make(map[string]*TxPublish),
+    commits: make(map[string]*PaxosMessage),
+    proposals: make(map[string]*proposal),
+    seen: make(map[string]bool),
+  }
+  if key := members[name]; key != nil {
+    if !bytes.Equal(key, identity.Public().(ed25519.PublicKey)) {
+      return nil, fmt.Errorf("the paxos member key of %s isn't its identity key", name)
+    }
+    consensus.identity = identity
+  }
+  return consensus, nil
+}
+
+func (consensus *NameConsensus) majority() int {
+  return consensus.Nodes / 2 + 1
+}
+
+func (consensus *NameConsensus) ResolveName(name string) *TxPublish {
+  return consensus.committed[name]
+}
+
+func (consensus *NameConsensus) Names() []*TxPublish {
+  return append([]*TxPublish{}, consensus.log...)
+}
+
+// Claims we proposed that didn't reach a majority yet.
+func (consensus *NameConsensus) Pending() []*TxPublish {
+  var pending []*TxPublish
+  for _, p := range consensus.proposals {
+    pending = append(pending, p.claim)
+  }
+  return pending
+}
+
+// What promises and accepts of a ballot are signed over.
+func paxosTranscript(msgType uint32, round uint32, proposer string, claim *TxPublish, acceptedRound uint32, acceptedProposer string) []byte {
+  var transcript bytes.Buffer
+  transcript.WriteString("peerster paxos")
+  binary.Write(&transcript, binary.BigEndian, msgType)
+  binary.Write(&transcript, binary.BigEndian, round)
+  binary.Write(&transcript, binary.BigEndian, uint32(len(proposer)))
+  transcript.WriteString(proposer)
+  hash := claim.Hash()
+  transcript.Write(hash[:])
+  binary.Write(&transcript, binary.BigEndian, acceptedRound)
+  transcript.WriteString(acceptedProposer)
+  return transcript.Bytes()
+}
+
+func (msg *PaxosMessage) transcript() []byte {
+  return paxosTranscript(msg.Type, msg.Round, msg.Proposer, &msg.Claim, msg.AcceptedRound, msg.AcceptedProposer)
+}
+
+func (consensus *NameConsensus) sign(msg *PaxosMessage) {
+  msg.Signature = ed25519.Sign(consensus.identity, msg.transcript())
+}
+
+// Whether msg comes from the member it claims to.
+func (consensus *NameConsensus) verify(origin string, transcript, signature []byte) bool {
+  key := consensus.members[origin]
+  return key != nil && ed25519.Verify(key, transcript, signature)
+}
+
+// Records a flooded message as seen, returns false if it already was.
+func (consensus *NameConsensus) markSeen(msg *PaxosMessage) bool {
+  hash := msg.Claim.Hash()
+  key := strconv.FormatUint(uint64(msg.Type), 10) + "/" + msg.Proposer + "/" +
+    strconv.FormatUint(uint64(msg.Round), 10) + "/" + hex.EncodeToString(hash[:])
+  if consensus.seen[key] {
+    return false
+  }
+  consensus.seen[key] = true
+  consensus.seenOrder = append(consensus.seenOrder, key)
+  if len(consensus.seenOrder) > MAX_PAXOS_SEEN {
+    delete(consensus.seen, consensus.seenOrder[0])
+    consensus.seenOrder = consensus.seenOrder[1:]
+  }
+  return true
+}
+
+func (consensus *NameConsensus) acceptor(name string) *acceptorState {
+  state := consensus.acceptors[name]
+  if state == nil {
+    state = &acceptorState{}
+    consensus.acceptors[name] = state
+  }
+  return state
+}
+
+// Makes the claim of a checked commit final, returns false if its name already was.
+func (consensus *NameConsensus) commit(msg *PaxosMessage) bool {
+  claim := msg.Claim
+  if consensus.committed[claim.Name] != nil {
+    return false
+  }
+  consensus.committed[claim.Name] = &claim
+  consensus.commits[claim.Name] = &PaxosMessage{
+    Type: PAXOS_COMMIT,
+    Proposer: msg.Proposer,
+    Round: msg.Round,
+    Claim: claim,
+    Votes: msg.Votes,
+  }
+  consensus.log = append(consensus.log, &claim)
+  fmt.Println("PAXOS COMMIT", claim.Name)
+  return true
+}
+
+// Commits in the order they were learned, to be saved.
+func (consensus *NameConsensus) Commits() []*PaxosMessage {
+  commits := make([]*PaxosMessage, 0, len(consensus.log))
+  for _, claim := range consensus.log {
+    commits = append(commits, consensus.commits[claim.Name])
+  }
+  return commits
+}
+
+// Restores a saved commit, if its votes still hold for the current members.
+func (consensus *NameConsensus) RestoreCommit(msg *PaxosMessage) bool {
+  return msg != nil && msg.Type == PAXOS_COMMIT && consensus.checkVotes(msg) && consensus.commit(msg)
+}
+
+// Sends the commit of a name to a proposer that missed it.
+func (gossiper *Gossiper) answerCommitted(msg *PaxosMessage) {
+  commit := *gossiper.Consensus.commits[msg.Claim.Name]
+  if msg.Proposer == gossiper.Name {
+    return
+  }
+  commit.Origin = gossiper.Name
+  commit.Destination = msg.Proposer
+  commit.HopLimit = PAXOS_HOP_LIMIT
+  gossiper.ForwardPaxosReply(&commit)
+}
+
+func (gossiper *Gossiper) ProposeName(claim *TxPublish) {
+  consensus := gossiper.Consensus
+  if committed := consensus.committed[claim.Name]; committed != nil {
+    if committed.Hash() != claim.Hash() {
+      fmt.Println("PAXOS REJECTED", claim.Name, "is claimed by another file")
+    }
+    return
+  }
+  if consensus.proposals[claim.Name] != nil {
+    return
+  }
+  p := &proposal{claim: claim}
+  consensus.proposals[claim.Name] = p
+  fmt.Println("PAXOS PROPOSE", claim.Name)
+  gossiper.openBallot(p)
+}
+
+// Opens a ballot above every one we saw for the name, until the claim ran
+// out of attempts.
+func (gossiper *Gossiper) openBallot(p *proposal) {
+  consensus := gossiper.Consensus
+  if p.attempts >= PAXOS_MAX_ATTEMPTS {
+    delete(consensus.proposals, p.claim.Name)
+    fmt.Println("PAXOS FAILED", p.claim.Name, "got", len(p.promises), "promises and", len(p.votes), "of", consensus.majority(), "votes")
+    return
+  }
+  p.attempts++
+  round := p.ballot.round
+  if p.seenRound > round {
+    round = p.seenRound
+  }
+  p.ballot = paxosBallot{round + 1, gossiper.Name}
+  p.value = p.claim
+  p.highest = paxosBallot{}
+  p.promises = make(map[string]bool)
+  p.votes = make(map[string][]byte)
+  p.proposing = false
+
+  ballot := p.ballot
+  var timeout chan bool
+  timeout = utils.SetTimeout(func() {
+    gossiper.Post(func() {
+      if consensus.proposals[p.claim.Name] == p && p.timeout == timeout {
+        gossiper.openBallot(p)
+      }
+    })
+  }, PAXOS_TIMEOUT)
+  p.timeout = timeout
+  gossiper.floodOwnPaxos(&PaxosMessage{
+    Type: PAXOS_PREPARE,
+    Proposer: ballot.proposer,
+    Round: ballot.round,
+    Claim: *p.claim,
+  })
+}
+
+// Sends a message of ours to everyone, and handles it as they do.
+func (gossiper *Gossiper) floodOwnPaxos(msg *PaxosMessage) {
+  msg.Origin = gossiper.Name
+  msg.HopLimit = PAXOS_HOP_LIMIT
+  gossiper.Consensus.markSeen(msg)
+  gossiper.ForwardToAllPeers(nil, &GossipPacket{Paxos: msg})
+  local := *msg
+  gossiper.handlePaxos(&local)
+}
+
+// Answers the proposer of a ballot, handling the answer directly if it is us.
+func (gossiper *Gossiper) replyPaxos(msg *PaxosMessage) {
+  msg.Origin = gossiper.Name
+  msg.Destination = msg.Proposer
+  msg.HopLimit = PAXOS_HOP_LIMIT
+  gossiper.Consensus.sign(msg)
+  if msg.Destination == gossiper.Name {
+    gossiper.handlePaxos(msg)
+    return
+  }
+  gossiper.ForwardPaxosReply(msg)
+}
+
+func (gossiper *Gossiper) ReceivePaxos(msg *PaxosMessage, sender *net.UDPAddr) {
+  consensus := gossiper.Consensus
+  if consensus == nil || msg.Claim.Name == "" || len(msg.Claim.MetafileHash) != sha256.Size {
+    return
+  }
+  switch {
+  case msg.Type == PAXOS_PROMISE || msg.Type == PAXOS_ACCEPT || msg.Type == PAXOS_COMMIT && msg.Destination != "":
+    if msg.Destination != gossiper.Name {
+      if DecrementHopLimit(&msg.HopLimit) {
+        gossiper.ForwardPaxosReply(msg)
+      }
+      return
+    }
+  default:
+    if !consensus.markSeen(msg) {
+      return
+    }
+    gossiper.floodPaxos(msg, sender)
+  }
+  gossiper.handlePaxos(msg)
+}
+
+func (gossiper *Gossiper) handlePaxos(msg *PaxosMessage) {
+  consensus := gossiper.Consensus
+  ballot := paxosBallot{msg.Round, msg.Proposer}
+  name := msg.Claim.Name
+  if p := consensus.proposals[name]; p != nil && msg.Round > p.seenRound && msg.Proposer != gossiper.Name {
+    p.seenRound = msg.Round
+  }
+
+  switch msg.Type {
+  case PAXOS_PREPARE:
+    if consensus.committed[name] != nil {
+      gossiper.answerCommitted(msg)
+      return
+    }
+    if consensus.identity == nil {
+      return
+    }
+    state := consensus.acceptor(name)
+    if ballot.less(state.promised) {
+      if state.promised.round <= msg.Round {
+        return
+      }
+      // Tells the proposer which round to go above
+      gossiper.replyPaxos(&PaxosMessage{
+        Type: PAXOS_PROMISE,
+        Proposer: msg.Proposer,
+        Round: state.promised.round,
+        Claim: msg.Claim,
+      })
+      return
+    }
+    state.promised = ballot
+    promise := &PaxosMessage{
+      Type: PAXOS_PROMISE,
+      Proposer: msg.Proposer,
+      Round: msg.Round,
+      Claim: msg.Claim,
+    }
+    if state.claim != nil {
+      promise.Claim = *state.claim
+      promise.AcceptedRound = state.accepted.round
+      promise.AcceptedProposer = state.accepted.proposer
+    }
+    gossiper.replyPaxos(promise)
+  case PAXOS_PROMISE:
+    p := consensus.proposals[name]
+    if p == nil || msg.Round > p.ballot.round {
+      if p != nil && msg.Round > p.seenRound {
+        p.seenRound = msg.Round
+      }
+      return
+    }
+    if ballot != p.ballot || p.proposing || !consensus.verify(msg.Origin, msg.transcript(), msg.Signature) {
+      return
+    }
+    p.promises[msg.Origin] = true
+    accepted := paxosBallot{msg.AcceptedRound, msg.AcceptedProposer}
+    if msg.AcceptedRound != 0 && p.highest.less(accepted) {
+      // A majority may have accepted it already, so it is the only claim we can propose
+      p.highest = accepted
+      claim := msg.Claim
+      p.value = &claim
+    }
+    if len(p.promises) >= consensus.majority() {
+      p.proposing = true
+      gossiper.floodOwnPaxos(&PaxosMessage{
+        Type: PAXOS_PROPOSE,
+        Proposer: p.ballot.proposer,
+        Round: p.ballot.round,
+        Claim: *p.value,
+      })
+    }
+  case PAXOS_PROPOSE:
+    if consensus.committed[name] != nil {
+      gossiper.answerCommitted(msg)
+      return
+    }
+    if consensus.identity == nil {
+      return
+    }
+    state := consensus.acceptor(name)
+    if ballot.less(state.promised) {
+      return
+    }
+    state.promised = ballot
+    state.accepted = ballot
+    claim := msg.Claim
+    state.claim = &claim
+    fmt.Println("PAXOS ACCEPT", name, "from", msg.Proposer, "round", msg.Round)
+    gossiper.replyPaxos(&PaxosMessage{
+      Type: PAXOS_ACCEPT,
+      Proposer: msg.Proposer,
+      Round: msg.Round,
+      Claim: msg.Claim,
+    })
+  case PAXOS_ACCEPT:
+    p := consensus.proposals[name]
+    if p == nil || ballot != p.ballot || !p.proposing || p.value.Hash() != msg.Claim.Hash() ||
+      !consensus.verify(msg.Origin, msg.transcript(), msg.Signature) {
+      return
+    }
+    p.votes[msg.Origin] = msg.Signature
+    if len(p.votes) < consensus.majority() {
+      return
+    }
+    commit := &PaxosMessage{
+      Type: PAXOS_COMMIT,
+      Proposer: p.ballot.proposer,
+      Round: p.ballot.round,
+      Claim: *p.value,
+    }
+    for origin, signature := range p.votes {
+      commit.Votes = append(commit.Votes, PaxosVote{origin, signature})
+    }
+    gossiper.floodOwnPaxos(commit)
+  case PAXOS_COMMIT:
+    if consensus.committed[name] != nil || !consensus.checkVotes(msg) || !consensus.commit(msg) {
+      return
+    }
+    if p := consensus.proposals[name]; p != nil {
+      delete(consensus.proposals, name)
+      if p.timeout != nil {
+        close(p.timeout)
+        p.timeout = nil
+      }
+      if p.claim.Hash() != msg.Claim.Hash() {
+        fmt.Println("PAXOS REJECTED", name, "is claimed by another file")
+      }
+    }
+  }
+}
+
+// Whether a commit carries the votes of a majority of members for its claim.
+func (consensus *NameConsensus) checkVotes(msg *PaxosMessage) bool {
+  transcript := paxosTranscript(PAXOS_ACCEPT, msg.Round, msg.Proposer, &msg.Claim, 0, "")
+  voters := make(map[string]bool)
+  for _, vote := range msg.Votes {
+    if !voters[vote.Origin] && consensus.verify(vote.Origin, transcript, vote.Signature) {
+      voters[vote.Origin] = true
+    }
+  }
+  if len(voters) < consensus.majority() {
+    fmt.Println("PAXOS IGNORED commit of", msg.Claim.Name, "with", len(voters), "valid votes")
+    return false
+  }
+  return true
+}
+
+func (gossiper *Gossiper) floodPaxos(msg *PaxosMessage, sender *net.UDPAddr) {
+  if msg.HopLimit <= 1 {
+    return
+  }
+  forwarded := *msg
+  forwarded.HopLimit--
+  gossiper.ForwardToAllPeers(sender, &GossipPacket{Paxos: &forwarded})
+}
+
+func (gossiper *Gossiper) ForwardPaxosReply(msg *PaxosMessage) {
+  if msg.HopLimit == 0 || gossiper.Router[msg.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[msg.Destination], &GossipPacket{Paxos: msg})
+}
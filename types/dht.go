@@ -0,0 +1,347 @@
+package types
+
+import (
+  "fmt"
+  "sort"
+  "time"
+  "bytes"
+  "math/rand"
+  "encoding/hex"
+  "crypto/sha256"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var DHT_K = 8 // Bucket size, and number of nodes a provider record is stored at
+var DHT_ALPHA = 3 // Parallel queries per lookup round
+var DHT_HOP_LIMIT = uint32(10)
+var DHT_LOOKUP_TIMEOUT = 3 * time.Second
+var PROVIDER_TTL = 5 * time.Minute
+var PROVIDER_REPUBLISH = time.Minute
+var MAX_PROVIDERS_PER_KEY = 20
+var MAX_PROVIDER_KEYS = 4096
+
+const (
+  DHT_STORE = uint32(1) // Provider announces it holds Key
+  DHT_FIND = uint32(2) // Asks for providers of Key
+  DHT_FOUND = uint32(3) // Answers a DHT_FIND with providers, or closer nodes
+)
+
+type DHTMessage struct {
+  Type uint32
+  Origin string
+  Destination string
+  HopLimit uint32
+  Nonce uint32 // Matches a DHT_FOUND to its DHT_FIND
+  Key []byte // Metahash
+  Providers []string
+  Closer []string
+}
+
+// Kademlia routing table over origin names, whose IDs are the SHA-256 of the name.
+// Bucket i holds the nodes whose ID shares exactly i leading bits with ours.
+type RoutingTable struct {
+  self [32]byte
+  buckets [256][]string
+}
+
+type dhtLookup struct {
+  key []byte
+  queried map[string]bool
+  answered map[string]bool
+  outstanding int // Queries sent in the current round that weren't answered
+  candidates []string
+  callback func(providers []string)
+  timeout chan bool
+}
+
+func NodeID(name string) [32]byte {
+  return sha256.Sum256([]byte(name))
+}
+
+func xorDistance(a [32]byte, b []byte) []byte {
+  distance := make([]byte, 32)
+  for i := range distance {
+    if i < len(b) {
+      distance[i] = a[i] ^ b[i]
+    } else {
+      distance[i] = a[i]
+    }
+  }
+  return distance
+}
+
+func NewRoutingTable(name string) *RoutingTable {
+  return &RoutingTable{self: NodeID(name)}
+}
+
+func (table *RoutingTable) bucketIndex(name string) int {
+  id := NodeID(name)
+  distance := xorDistance(table.self, id[:])
+  for i, b := range distance {
+    for bit := 0; bit < 8; bit++ {
+      if b & (0x80 >> uint(bit)) != 0 {
+        return i * 8 + bit
+      }
+    }
+  }
+  return 255
+}
+
+// Adds a node, keeping the oldest ones when its bucket is full as Kademlia does.
+func (table *RoutingTable) Add(name string) {
+  index := table.bucketIndex(name)
+  for _, known := range table.buckets[index] {
+    if known == name {
+      return
+    }
+  }
+  if len(table.buckets[index]) < DHT_K {
+    table.buckets[index] = append(table.buckets[index], name)
+  }
+}
+
+// Returns up to count known nodes sorted by XOR distance to key.
+func (table *RoutingTable) Closest(key []byte, count int) []string {
+  var all []string
+  for _, bucket := range table.buckets {
+    all = append(all, bucket...)
+  }
+  sortByDistance(all, key)
+  if len(all) > count {
+    all = all[:count]
+  }
+  return all
+}
+
+func sortByDistance(names []string, key []byte) {
+  sort.Slice(names, func(i, j int) bool {
+    return bytes.Compare(xorDistance(NodeID(names[i]), key), xorDistance(NodeID(names[j]), key)) < 0
+  })
+}
+
+// Whether we are among the DHT_K nodes closest to key that we know of.
+func (gossiper *Gossiper) isCloseTo(key []byte) bool {
+  closest := gossiper.DHT.Closest(key, DHT_K)
+  if len(closest) < DHT_K {
+    return true
+  }
+  farthest := NodeID(closest[len(closest) - 1])
+  self := NodeID(gossiper.Name)
+  return bytes.Compare(xorDistance(self, key), xorDistance(farthest, key)) <= 0
+}
+
+func (gossiper *Gossiper) storeProvider(key []byte, provider string) {
+  hash := hex.EncodeToString(key)
+  records := gossiper.Providers[hash]
+  if records == nil {
+    if len(gossiper.Providers) >= MAX_PROVIDER_KEYS {
+      return
+    }
+    records = make(map[string]time.Time)
+    gossiper.Providers[hash] = records
+  }
+  if _, exists := records[provider]; !exists && len(records) >= MAX_PROVIDERS_PER_KEY {
+    return
+  }
+  records[provider] = time.Now().Add(PROVIDER_TTL)
+}
+
+// Providers of key we hold records for, other than us.
+func (gossiper *Gossiper) localProviders(key []byte) []string {
+  hash := hex.EncodeToString(key)
+  var providers []string
+  for provider, expires := range gossiper.Providers[hash] {
+    if time.Now().After(expires) {
+      delete(gossiper.Providers[hash], provider)
+    } else if provider != gossiper.Name {
+      providers = append(providers, provider)
+    }
+  }
+  return providers
+}
+
+func (gossiper *Gossiper) SendDHTMessage(msg *DHTMessage) {
+  if msg.HopLimit == 0 || gossiper.Router[msg.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[msg.Destination], &GossipPacket{DHT: msg})
+}
+
+// Announces that we hold key to the nodes closest to it.
+func (gossiper *Gossiper) AnnounceProvider(key []byte) {
+  if gossiper.isCloseTo(key) {
+    gossiper.storeProvider(key, gossiper.Name)
+  }
+  for _, node := range gossiper.DHT.Closest(key, DHT_K) {
+    gossiper.SendDHTMessage(&DHTMessage{
+      Type: DHT_STORE,
+      Origin: gossiper.Name,
+      Destination: node,
+      HopLimit: DHT_HOP_LIMIT,
+      Key: key,
+    })
+  }
+}
+
+// Announces the files we hold to a node we just learned about, if it's among
+// the closest to them.
+func (gossiper *Gossiper) AnnounceProvidersTo(node string) {
+  for _, file := range gossiper.Files {
+    if !file.IsComplete() {
+      continue
+    }
+    for _, closest := range gossiper.DHT.Closest(file.MetaHash, DHT_K) {
+      if closest == node {
+        gossiper.SendDHTMessage(&DHTMessage{
+          Type: DHT_STORE,
+          Origin: gossiper.Name,
+          Destination: node,
+          HopLimit: DHT_HOP_LIMIT,
+          Key: file.MetaHash,
+        })
+      }
+    }
+  }
+}
+
+// Re-announces the files we hold, even partly, before their records expire.
+func (gossiper *Gossiper) RepublishProviders() {
+  for _, file := range gossiper.Files {
+    if file.MetaFile != nil {
+      gossiper.AnnounceProvider(file.MetaHash)
+    }
+  }
+}
+
+// Looks up the providers of key, then calls callback with them (nil if none was found).
+func (gossiper *Gossiper) FindProviders(key []byte, callback func(providers []string)) {
+  if providers := gossiper.localProviders(key); len(providers) > 0 {
+    callback(providers)
+    return
+  }
+  nonce := rand.Uint32() | 1
+  lookup := &dhtLookup{
+    key: key,
+    queried: map[string]bool{gossiper.Name: true},
+    answered: make(map[string]bool),
+    candidates: gossiper.DHT.Closest(key, DHT_K),
+    callback: callback,
+  }
+  gossiper.DHTLookups[nonce] = lookup
+  fmt.Println("DHT LOOKUP", hex.EncodeToString(key))
+  gossiper.continueLookup(nonce)
+}
+
+// Queries the next DHT_ALPHA closest nodes that weren't asked yet.
+func (gossiper *Gossiper) continueLookup(nonce uint32) {
+  lookup := gossiper.DHTLookups[nonce]
+  if lookup == nil {
+    return
+  }
+  sent := 0
+  for _, node := range lookup.candidates {
+    if sent == DHT_ALPHA {
+      break
+    }
+    if lookup.queried[node] {
+      continue
+    }
+    lookup.queried[node] = true
+    sent++
+    gossiper.SendDHTMessage(&DHTMessage{
+      Type: DHT_FIND,
+      Origin: gossiper.Name,
+      Destination: node,
+      HopLimit: DHT_HOP_LIMIT,
+      Nonce: nonce,
+      Key: lookup.key,
+    })
+  }
+  lookup.outstanding += sent
+  if lookup.outstanding == 0 {
+    gossiper.finishLookup(nonce, nil)
+    return
+  }
+  if sent == 0 {
+    return
+  }
+  if lookup.timeout != nil {
+    close(lookup.timeout)
+  }
+  // Unanswered queries are given up on after the timeout
+  var timeout chan bool
+  timeout = utils.SetTimeout(func() {
+    gossiper.Post(func() {
+      if gossiper.DHTLookups[nonce] != lookup || lookup.timeout != timeout {
+        return
+      }
+      lookup.timeout = nil
+      lookup.outstanding = 0
+      gossiper.continueLookup(nonce)
+    })
+  }, DHT_LOOKUP_TIMEOUT)
+  lookup.timeout = timeout
+}
+
+func (gossiper *Gossiper) finishLookup(nonce uint32, providers []string) {
+  lookup := gossiper.DHTLookups[nonce]
+  if lookup == nil {
+    return
+  }
+  delete(gossiper.DHTLookups, nonce)
+  if lookup.timeout != nil {
+    close(lookup.timeout)
+  }
+  fmt.Println("DHT FOUND", len(providers), "providers of", hex.EncodeToString(lookup.key))
+  lookup.callback(providers)
+}
+
+func (gossiper *Gossiper) ReceiveDHTMessage(msg *DHTMessage) {
+  if msg.Destination != gossiper.Name {
+    if DecrementHopLimit(&msg.HopLimit) {
+      gossiper.SendDHTMessage(msg)
+    }
+    return
+  }
+  if len(msg.Key) != sha256.Size {
+    return
+  }
+  gossiper.DHT.Add(msg.Origin)
+
+  switch msg.Type {
+  case DHT_STORE:
+    gossiper.storeProvider(msg.Key, msg.Origin)
+  case DHT_FIND:
+    gossiper.SendDHTMessage(&DHTMessage{
+      Type: DHT_FOUND,
+      Origin: gossiper.Name,
+      Destination: msg.Origin,
+      HopLimit: DHT_HOP_LIMIT,
+      Nonce: msg.Nonce,
+      Key: msg.Key,
+      Providers: gossiper.localProviders(msg.Key),
+      Closer: gossiper.DHT.Closest(msg.Key, DHT_K),
+    })
+  case DHT_FOUND:
+    lookup := gossiper.DHTLookups[msg.Nonce]
+    if lookup == nil || !bytes.Equal(lookup.key, msg.Key) || !lookup.queried[msg.Origin] || lookup.answered[msg.Origin] {
+      return
+    }
+    lookup.answered[msg.Origin] = true
+    if lookup.outstanding > 0 {
+      lookup.outstanding--
+    }
+    if len(msg.Providers) > 0 {
+      gossiper.finishLookup(msg.Nonce, msg.Providers)
+      return
+    }
+    // Only nodes we can route to are worth asking
+    for _, node := range msg.Closer {
+      if node != gossiper.Name && gossiper.Router[node] != nil && !lookup.queried[node] {
+        lookup.candidates = append(lookup.candidates, node)
+      }
+    }
+    sortByDistance(lookup.candidates, lookup.key)
+    gossiper.continueLookup(msg.Nonce)
+  }
+}
@@ -0,0 +1,344 @@
+package types
+
+import (
+  "fmt"
+  "sort"
+  "time"
+  "errors"
+  "math/rand"
+  "encoding/hex"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var MAX_ACTIVE_DOWNLOADS = 3 // Default of Gossiper.MaxActiveDownloads
+var DOWNLOAD_RETRIES = 5 // Default of Gossiper.DownloadRetries
+var DOWNLOAD_RETRY_DELAY = 5 * time.Second // Doubled after each unanswered request
+var MAX_DOWNLOAD_RETRY_DELAY = time.Minute
+
+const (
+  DOWNLOAD_QUEUED = "queued"
+  DOWNLOAD_METAFILE = "fetching-metafile"
+  DOWNLOAD_CHUNKS = "downloading"
+  DOWNLOAD_PAUSED = "paused"
+  DOWNLOAD_COMPLETED = "completed"
+  DOWNLOAD_FAILED = "failed"
+)
+
+// A DataRequest we sent, until it is answered or times out.
+type pendingDataRequest struct {
+  file string // Hex encoded metahash of the file it is for
+  destination string
+  hash string // Hex encoded hash it asks for
+  timeout chan bool
+}
+
+type Download struct {
+  Hash string // Hex encoded metahash
+  FileName string
+  Source string // Who we download from, looked up in the DHT if empty
+  State string
+  Priority int // Higher ones start first
+  Retries int // Requests left unanswered in a row
+  Error string // Why it failed
+  Received int64 // Chunks we hold, in metafile order
+  NumChunks int64
+  order uint64 // Downloads of the same priority start in the order they were added
+}
+
+func (download *Download) IsActive() bool {
+  return download.State == DOWNLOAD_METAFILE || download.State == DOWNLOAD_CHUNKS
+}
+
+// Adds a download, which starts once fewer than MaxActiveDownloads are
+// active. A download of that file that was paused, failed or completed is
+// started again, one that is queued or active is left as is. A file we
+// already hold in full is completed right away. The file of a directory is
+// its manifest, and the files it lists are downloaded once it completes.
+func (gossiper *Gossiper) QueueDownload(metaHash []byte, fileName, source string, priority int, directory bool) *Download {
+  key := hex.EncodeToString(metaHash)
+  if download := gossiper.Downloads[key]; download != nil && (download.IsActive() || download.State == DOWNLOAD_QUEUED) {
+    return download
+  }
+  // A file we already hold is left as is, partial downloads pick up where
+  // they stopped
+  file := gossiper.Files[key]
+  if file != nil && file.MetaFile != nil && file.IsComplete() {
+    fmt.Println("ALREADY HAVE file", file.FileName, key)
+    return gossiper.addDownload(key, fileName, source, priority, DOWNLOAD_COMPLETED)
+  }
+  if file == nil || file.MetaFile == nil {
+    gossiper.AddStubFile(key, metaHash, fileName)
+  }
+  if directory {
+    gossiper.Files[key].Directory = true
+  }
+  download := gossiper.addDownload(key, fileName, source, priority, DOWNLOAD_QUEUED)
+  gossiper.startDownloads()
+  return download
+}
+
+func (gossiper *Gossiper) addDownload(key, fileName, source string, priority int, state string) *Download {
+  gossiper.downloadSeq++
+  download := &Download{
+    Hash: key,
+    FileName: fileName,
+    Source: source,
+    State: state,
+    Priority: priority,
+    order: gossiper.downloadSeq,
+  }
+  gossiper.Downloads[key] = download
+  return download
+}
+
+// Starts queued downloads, highest priority first, while there are free slots.
+func (gossiper *Gossiper) startDownloads() {
+  active := 0
+  var queued []*Download
+  for _, download := range gossiper.Downloads {
+    if download.IsActive() {
+      active++
+    } else if download.State == DOWNLOAD_QUEUED {
+      queued = append(queued, download)
+    }
+  }
+  sort.Slice(queued, func(i, j int) bool {
+    if queued[i].Priority != queued[j].Priority {
+      return queued[i].Priority > queued[j].Priority
+    }
+    return queued[i].order < queued[j].order
+  })
+  for _, download := range queued {
+    if active >= gossiper.MaxActiveDownloads {
+      return
+    }
+    if gossiper.startDownload(download) {
+      active++
+    }
+  }
+}
+
+// Returns false if download failed right away, its file being gone.
+func (gossiper *Gossiper) startDownload(download *Download) bool {
+  file := gossiper.Files[download.Hash]
+  if file == nil {
+    download.State = DOWNLOAD_FAILED
+    download.Error = "file was removed"
+    fmt.Println("FAILED download of", download.FileName + ":", download.Error)
+    return false
+  }
+  download.Retries = 0
+  download.Error = ""
+  download.State = DOWNLOAD_CHUNKS
+  if file.MetaFile == nil {
+    download.State = DOWNLOAD_METAFILE
+  }
+  fmt.Println("STARTING download of", download.FileName, download.Hash)
+  if download.Source != "" {
+    gossiper.requestDownload(download)
+    return true
+  }
+  // Find who holds the file through the DHT
+  gossiper.FindProviders(file.MetaHash, func(providers []string) {
+    if gossiper.Downloads[download.Hash] != download || !download.IsActive() {
+      return
+    }
+    if len(providers) == 0 {
+      gossiper.failDownload(download, "no providers found")
+      return
+    }
+    download.Source = providers[rand.Intn(len(providers))]
+    gossiper.requestDownload(download)
+  })
+  return true
+}
+
+// Requests the metafile, or the first chunk we miss from any peer known to
+// hold it. If none is, the request is only retried once bitmaps had time to
+// arrive.
+func (gossiper *Gossiper) requestDownload(download *Download) {
+  file := gossiper.Files[download.Hash]
+  if file == nil {
+    gossiper.failDownload(download, "file was removed")
+    return
+  }
+  rq := &DataRequest{
+    Origin: gossiper.Name,
+    Destination: download.Source,
+    HopLimit: 10,
+    HashValue: file.MetaHash,
+  }
+  if file.MetaFile != nil {
+    rq.HashValue = file.MetaFile[file.Status * 32:(file.Status + 1) * 32]
+    rq.Destination = gossiper.ChunkSource(file, int(file.Status), download.Source)
+  }
+  gossiper.SendDataRequest(rq, download)
+}
+
+// Sends rq under a new nonce, and asks again with exponential backoff while
+// download waits for it, failing the download after DownloadRetries requests
+// went unanswered. A download has one request out at a time.
+func (gossiper *Gossiper) SendDataRequest(rq *DataRequest, download *Download) {
+  gossiper.cancelDataRequests(download.Hash)
+  rq.Nonce = rand.Uint32() | 1
+  for gossiper.DataRequests[rq.Nonce] != nil {
+    rq.Nonce = rand.Uint32() | 1
+  }
+  if rq.Destination != "" {
+    gossiper.ForwardDataRequest(rq)
+  }
+  delay := DOWNLOAD_RETRY_DELAY << uint(download.Retries)
+  if delay > MAX_DOWNLOAD_RETRY_DELAY || delay <= 0 {
+    delay = MAX_DOWNLOAD_RETRY_DELAY
+  }
+  nonce := rq.Nonce
+  pending := &pendingDataRequest{
+    file: download.Hash,
+    destination: rq.Destination,
+    hash: hex.EncodeToString(rq.HashValue),
+  }
+  gossiper.DataRequests[nonce] = pending
+  pending.timeout = utils.SetTimeout(func() {
+    gossiper.Post(func() {
+      if gossiper.DataRequests[nonce] != pending {
+        return
+      }
+      delete(gossiper.DataRequests, nonce)
+      if gossiper.Downloads[download.Hash] != download || !download.IsActive() {
+        return
+      }
+      download.Retries++
+      if download.Retries >= gossiper.DownloadRetries {
+        gossiper.failDownload(download, fmt.Sprintf("no reply to %d requests", download.Retries))
+        return
+      }
+      fmt.Println("RETRYING download of", download.FileName, "after", delay)
+      // Holders come and go, so ask again who has what
+      if file := gossiper.Files[download.Hash]; file != nil && file.MetaFile != nil {
+        gossiper.forgetChunkMap(download.Hash, pending.destination)
+        gossiper.DiscoverChunkHolders(file, "")
+      }
+      gossiper.requestDownload(download)
+    })
+  }, delay)
+}
+
+func (gossiper *Gossiper) cancelDataRequest(nonce uint32) {
+  if pending := gossiper.DataRequests[nonce]; pending != nil {
+    close(pending.timeout)
+    delete(gossiper.DataRequests, nonce)
+  }
+}
+
+// Cancels the requests sent for the file of that metahash.
+func (gossiper *Gossiper) cancelDataRequests(key string) {
+  for nonce, pending := range gossiper.DataRequests {
+    if pending.file == key {
+      gossiper.cancelDataRequest(nonce)
+    }
+  }
+}
+
+// Cancels the request download waits for, if any.
+func (gossiper *Gossiper) stopDownload(download *Download) {
+  gossiper.cancelDataRequests(download.Hash)
+}
+
+func (gossiper *Gossiper) failDownload(download *Download, reason string) {
+  gossiper.stopDownload(download)
+  download.State = DOWNLOAD_FAILED
+  download.Error = reason
+  fmt.Println("FAILED download of", download.FileName + ":", reason)
+  gossiper.startDownloads()
+}
+
+func (gossiper *Gossiper) completeDownload(download *Download) {
+  download.State = DOWNLOAD_COMPLETED
+  gossiper.startDownloads()
+}
+
+func (gossiper *Gossiper) PauseDownload(key string) error {
+  download := gossiper.Downloads[key]
+  if download == nil {
+    return errors.New("no such download")
+  }
+  if !download.IsActive() && download.State != DOWNLOAD_QUEUED {
+    return fmt.Errorf("can't pause a download that is %s", download.State)
+  }
+  gossiper.stopDownload(download)
+  download.State = DOWNLOAD_PAUSED
+  gossiper.startDownloads()
+  return nil
+}
+
+// Queues a paused or failed download again.
+func (gossiper *Gossiper) ResumeDownload(key string) error {
+  download := gossiper.Downloads[key]
+  if download == nil {
+    return errors.New("no such download")
+  }
+  if download.State != DOWNLOAD_PAUSED && download.State != DOWNLOAD_FAILED {
+    return fmt.Errorf("can't resume a download that is %s", download.State)
+  }
+  download.State = DOWNLOAD_QUEUED
+  gossiper.startDownloads()
+  return nil
+}
+
+// Stops a download and forgets the chunks it received. Finished downloads
+// are only removed from the list, their file is kept.
+func (gossiper *Gossiper) CancelDownload(key string) error {
+  download := gossiper.Downloads[key]
+  if download == nil {
+    return errors.New("no such download")
+  }
+  delete(gossiper.Downloads, key)
+  if download.State != DOWNLOAD_COMPLETED {
+    gossiper.stopDownload(download)
+    if file := gossiper.Files[key]; file != nil && !file.IsComplete() {
+      gossiper.RemoveFile(key, file.FileName)
+    }
+  }
+  gossiper.startDownloads()
+  return nil
+}
+
+// Changes the order queued downloads start in. Active ones aren't stopped.
+func (gossiper *Gossiper) PrioritizeDownload(key string, priority int) error {
+  download := gossiper.Downloads[key]
+  if download == nil {
+    return errors.New("no such download")
+  }
+  download.Priority = priority
+  return nil
+}
+
+// Downloads with their progress, active ones first, then in the order they start.
+func (gossiper *Gossiper) DownloadList() []*Download {
+  rank := map[string]int{
+    DOWNLOAD_METAFILE: 0,
+    DOWNLOAD_CHUNKS: 0,
+    DOWNLOAD_QUEUED: 1,
+    DOWNLOAD_PAUSED: 2,
+    DOWNLOAD_FAILED: 3,
+    DOWNLOAD_COMPLETED: 4,
+  }
+  list := make([]*Download, 0, len(gossiper.Downloads))
+  for _, download := range gossiper.Downloads {
+    if file := gossiper.Files[download.Hash]; file != nil && file.Status >= 0 {
+      download.Received, download.NumChunks = file.Status, file.NumChunks
+    }
+    list = append(list, download)
+  }
+  sort.Slice(list, func(i, j int) bool {
+    a, b := list[i], list[j]
+    if rank[a.State] != rank[b.State] {
+      return rank[a.State] < rank[b.State]
+    }
+    if a.Priority != b.Priority {
+      return a.Priority > b.Priority
+    }
+    return a.order < b.order
+  })
+  return list
+}
@@ -1,18 +1,23 @@
 package types
 
 import (
-  "os"
   "net"
   "fmt"
   "time"
+  "sort"
   "strings"
   "math/rand"
   "encoding/hex"
+  "crypto/ecdh"
   "crypto/sha256"
   "github.com/nt1m/Peerster/utils"
 )
 
 var FILE_CHUNK_SIZE = int64(8192)
+var MAX_PENDING_RUMORS = 64 // Per origin
+var MAX_PENDING_RUMORS_TOTAL = 1024 // Over all origins, as anyone can make up new ones
+var MAX_GAP_REQUEST_IDS = 32
+var MAX_CHANNEL_NAME_LENGTH = 64
 
 type File struct {
   FileName string
@@ -22,6 +27,15 @@ type File struct {
   MetaHash []byte
   MetaFile []byte
   Status int64
+  Mode uint32 // Permission bits it is downloaded with, 0 for the default
+  Copies []string // Other names it is downloaded as, when a directory has it several times
+  Directory bool // Holds the manifest of a directory tree, whatever its content
+}
+
+// A rumor that arrived ahead of sequence, with who sent it.
+type pendingRumor struct {
+  rumor *RumorMessage
+  sender *net.UDPAddr
 }
 
 type Client struct {
@@ -32,15 +46,60 @@ type Client struct {
 type Gossiper struct {
   Address *net.UDPAddr
   Conn *net.UDPConn
+  UIAddress string // Where the UI client requests of this gossiper are sent
   Name string
+  SimpleMode bool // Broadcast simple messages instead of gossiping rumors
   Peers []*net.UDPAddr
+  SimpleSeq uint32 // Last ID of our simple messages
+  SeenSimple map[string]bool // Keys of the simple messages we relayed
+  SeenSimpleOrder []string // Same keys, oldest first, to bound the cache
   Rumors map[string]map[uint32]*RumorMessage // Map[Origin -> Map[Identifier][RumorMessage]]
+  PendingRumors map[string]map[uint32]*pendingRumor // Rumors that arrived ahead of sequence
   VisibleMessages []*GossipPacket
+  Channels map[string]bool // Subscribed channels
+  ChannelHistory map[string][]*RumorMessage // Map[Channel -> Rumors in arrival order]
   Router map[string]*net.UDPAddr // Map[Origin -> UDPAddr]
+  PrivateSeq map[string]uint32 // Map[Destination -> Last ID sent]
+  OutgoingPrivates map[string]*OutgoingPrivate // Map[Destination/ID -> Delivery state]
+  ReceivedPrivates map[string]*ReceivedIDs // Map[Origin -> Received IDs]
+  Outbox map[string][]*OutboxEntry // Map[Destination -> Packets waiting for a route]
+  IsMailbox bool // Whether we hold mail for unreachable destinations
+  MailKey *ecdh.PrivateKey // Decrypts the mail left for us
+  MailKeys map[string][]byte // Map[Origin -> X25519 public key]
+  Mailboxes map[string]bool // Origins that hold mail for others
   Timeouts map[string](chan bool)
-  DataRequestTimeouts map[string](chan bool)
+  DataRequests map[uint32]*pendingDataRequest // Map[Nonce -> Request waiting for its reply]
+  Downloads map[string]*Download // Map[Metahash -> Download]
+  downloadSeq uint64
+  DownloadDir string // Where downloaded files are written
+  MaxActiveDownloads int
+  DownloadRetries int // Unanswered requests in a row before a download fails
   Files map[string]*File // Map[Hash -> File]
+  ChunkStore map[string][]byte // Map[Hash -> Chunk], one copy shared by all files
+  Shares *ShareWatcher // Finds the files we share
+  Chain *Blockchain // Agreed file names
+  Consensus *NameConsensus // Replaces Chain for file names when set
+  DHT *RoutingTable
+  Providers map[string]map[string]time.Time // Map[Metahash -> Map[Origin -> Expiry]], records stored at us
+  DHTLookups map[uint32]*dhtLookup // Map[Nonce -> Lookup in progress]
+  PeerChunkMaps map[string]map[string][]byte // Map[Metahash -> Map[Origin -> Chunk bitmap]]
+  Scheduler *SendScheduler // Shapes outgoing traffic when set
+  RequestRate float64 // Requests per second each peer can make, 0 for unlimited
+  RequestLimits map[string]*TokenBucket // Map[Peer -> Inbound requests]
+  requestLimitsSwept time.Time
   LastRumor map[string]*RumorMessage
+  Quit chan bool // Closed on shutdown
+  Tasks chan func() // Work handed over to the event loop by timers and other goroutines
+  Rejected map[string]uint64 // Map[Variant -> Packets rejected by validation]
+  Policy *PeerPolicy // Who can become our peer
+  Joining map[string]bool // Peers we are answering a join challenge of
+  Link *LinkAuth // Authenticates packets between neighbors when set
+  OnionKey *ecdh.PrivateKey // Nil if we don't take part in onion routing
+  OnionKeys map[string][]byte // Map[Origin -> X25519 public key]
+  OnionHops int // Relays between us and the destination of our circuits
+  OnionCircuits map[uint64]*onionCircuit // Circuits we built, by first segment
+  OnionRelays map[uint64]*onionReturn // Circuits we relay, by outgoing segment
+  OnionReplies map[string]*onionReturn // Map[Origin -> Circuit it last reached us with]
   LastInteraction *net.UDPAddr
 }
 
@@ -68,6 +127,9 @@ func NewGossiper(address, name, peerStr string) *Gossiper {
 
   var peerAddrs []*net.UDPAddr
   for _,peer := range peers {
+    if peer == "" {
+      continue
+    }
     peerAddr, err := net.ResolveUDPAddr("udp4", peer)
     utils.CheckError(err)
     peerAddrs = append(peerAddrs, peerAddr)
@@ -78,12 +140,68 @@ func NewGossiper(address, name, peerStr string) *Gossiper {
     Conn: udpConn,
     Name: name,
     Peers: peerAddrs,
+    SeenSimple: make(map[string]bool),
     Rumors: make(map[string]map[uint32]*RumorMessage),
+    PendingRumors: make(map[string]map[uint32]*pendingRumor),
     Router: make(map[string]*net.UDPAddr),
+    PrivateSeq: make(map[string]uint32),
+    OutgoingPrivates: make(map[string]*OutgoingPrivate),
+    ReceivedPrivates: make(map[string]*ReceivedIDs),
+    Outbox: make(map[string][]*OutboxEntry),
+    MailKeys: make(map[string][]byte),
+    Mailboxes: make(map[string]bool),
+    Channels: make(map[string]bool),
+    ChannelHistory: make(map[string][]*RumorMessage),
     Files: make(map[string]*File),
+    ChunkStore: make(map[string][]byte),
+    Chain: NewBlockchain(),
+    DHT: NewRoutingTable(name),
+    Providers: make(map[string]map[string]time.Time),
+    DHTLookups: make(map[uint32]*dhtLookup),
+    PeerChunkMaps: make(map[string]map[string][]byte),
+    RequestLimits: make(map[string]*TokenBucket),
     Timeouts: make(map[string](chan bool)),
-    DataRequestTimeouts: make(map[string](chan bool)),
+    DataRequests: make(map[uint32]*pendingDataRequest),
+    Downloads: make(map[string]*Download),
+    DownloadDir: DOWNLOAD_DIR,
+    MaxActiveDownloads: MAX_ACTIVE_DOWNLOADS,
+    DownloadRetries: DOWNLOAD_RETRIES,
     LastRumor: make(map[string]*RumorMessage),
+    Quit: make(chan bool),
+    Tasks: make(chan func()),
+    Rejected: make(map[string]uint64),
+    Policy: NewPeerPolicy(),
+    Joining: make(map[string]bool),
+    OnionKeys: make(map[string][]byte),
+    OnionHops: ONION_HOPS,
+    OnionCircuits: make(map[uint64]*onionCircuit),
+    OnionRelays: make(map[uint64]*onionReturn),
+    OnionReplies: make(map[string]*onionReturn),
+  }
+}
+
+// Runs task on the event loop, which owns the gossiper's state. Dropped if
+// the gossiper stops first.
+func (gossiper* Gossiper) Post(task func()) {
+  go func() {
+    select {
+    case gossiper.Tasks <- task:
+    case <-gossiper.Quit:
+    }
+  }()
+}
+
+// Runs task on the event loop and waits for it, for goroutines like the web
+// server's. Returns false if the gossiper stopped first. Never call it from
+// the event loop itself.
+func (gossiper* Gossiper) Do(task func()) bool {
+  done := make(chan bool)
+  select {
+  case gossiper.Tasks <- func() { task(); close(done) }:
+    <-done
+    return true
+  case <-gossiper.Quit:
+    return false
   }
 }
 
@@ -142,73 +260,110 @@ func (gossiper* Gossiper) RecordRumor(rm *RumorMessage) {
     gossiper.Rumors[rm.Origin] = make(map[uint32]*RumorMessage)
   }
   gossiper.Rumors[rm.Origin][rm.ID] = rm
-  if (rm.Text != "") {
-    gossiper.VisibleMessages = append(gossiper.VisibleMessages, &GossipPacket{nil, rm, nil, nil, nil, nil})
+  if len(rm.OnionKey) == ONION_KEY_SIZE && rm.Origin != gossiper.Name {
+    gossiper.OnionKeys[rm.Origin] = rm.OnionKey
+  }
+  if len(rm.MailKey) == ONION_KEY_SIZE && rm.Origin != gossiper.Name {
+    gossiper.MailKeys[rm.Origin] = rm.MailKey
+    gossiper.Mailboxes[rm.Origin] = rm.Mailbox
   }
+  if (rm.Text == "") {
+    return
+  }
+  // Only channels we joined keep a history, anyone can make up new ones
+  if rm.Channel != "" && gossiper.Channels[rm.Channel] {
+    gossiper.ChannelHistory[rm.Channel] = append(gossiper.ChannelHistory[rm.Channel], rm)
+  }
+  if rm.Channel == "" || gossiper.Channels[rm.Channel] {
+    gossiper.VisibleMessages = append(gossiper.VisibleMessages, &GossipPacket{Rumor: rm})
+  }
+}
+
+func IsValidChannelName(name string) bool {
+  return name != "" && len(name) <= MAX_CHANNEL_NAME_LENGTH && !strings.ContainsAny(name, " \t\r\n/#")
+}
+
+// Subscribes to a channel, creating it locally if nobody posted to it yet.
+func (gossiper* Gossiper) JoinChannel(name string) bool {
+  if !IsValidChannelName(name) {
+    return false
+  }
+  gossiper.Channels[name] = true
+  fmt.Println("JOINED channel", name)
+  return true
+}
+
+func (gossiper* Gossiper) LeaveChannel(name string) {
+  delete(gossiper.Channels, name)
+  delete(gossiper.ChannelHistory, name)
+  fmt.Println("LEFT channel", name)
+}
+
+func (gossiper* Gossiper) ChannelsAsList() []string {
+  list := make([]string, 0, len(gossiper.Channels))
+  for name := range gossiper.Channels {
+    list = append(list, name)
+  }
+  sort.Strings(list)
+  return list
 }
 
 func (gossiper* Gossiper) RecordPrivate(msg *PrivateMessage) {
-  gossiper.VisibleMessages = append(gossiper.VisibleMessages, &GossipPacket{nil, nil, nil, msg, nil, nil})
+  gossiper.VisibleMessages = append(gossiper.VisibleMessages, &GossipPacket{Private: msg})
 }
 
 func (gossiper* Gossiper) ForwardPrivate(pm *PrivateMessage) {
-  if pm.HopLimit > 0 {
-    gossiper.SendPacket(
-      gossiper.Router[pm.Destination],
-      &GossipPacket{nil, nil, nil, pm, nil, nil})
+  if pm.HopLimit == 0 {
+    return
+  }
+  if gossiper.Router[pm.Destination] == nil {
+    gossiper.QueuePacket(pm.Destination, &GossipPacket{Private: pm}, time.Now().Add(OUTBOX_EXPIRY))
+    return
   }
+  gossiper.SendPacket(
+    gossiper.Router[pm.Destination],
+    &GossipPacket{Private: pm})
 }
 
+// Answers with the metafile or chunk of that hash, from complete as well as
+// partially downloaded files.
 func (gossiper* Gossiper) ReplyDataRequest(rq *DataRequest) {
   key := hex.EncodeToString(rq.HashValue)
-  if gossiper.Files[key] != nil {
-    file := gossiper.Files[key]
-
+  var data []byte
+  if gossiper.Files[key] != nil && gossiper.Files[key].MetaFile != nil {
     fmt.Println("ReplyDataRequest: ", key, "found")
-    gossiper.SendPacket(
-      gossiper.Router[rq.Origin],
-      &GossipPacket{nil, nil, nil, nil, nil, &DataReply{
-        Origin: gossiper.Name,
-        Destination: rq.Origin,
-        HashValue: rq.HashValue,
-        Data: file.MetaFile,
-      }},
-    )
+    data = gossiper.Files[key].MetaFile
   } else {
-    // Lookup file chunk with right hash.
-    for _, file := range gossiper.Files {
-      if file.Chunks[key] != nil {
-        gossiper.SendPacket(
-          gossiper.Router[rq.Origin],
-          &GossipPacket{nil, nil, nil, nil, nil, &DataReply{
-            Origin: gossiper.Name,
-            Destination: rq.Origin,
-            HashValue: rq.HashValue,
-            Data: file.Chunks[key],
-          }},
-        )
-      } else {
-        fmt.Println("ReplyDataRequest: FAILED TO FIND CHUNK WITH HASH", hex.EncodeToString(rq.HashValue))
-      }
-    }
+    data = gossiper.ChunkStore[key]
   }
+  if data == nil {
+    fmt.Println("ReplyDataRequest: FAILED TO FIND CHUNK WITH HASH", key)
+    return
+  }
+  gossiper.SendPacket(
+    gossiper.Router[rq.Origin],
+    &GossipPacket{DataReply: &DataReply{
+      Origin: gossiper.Name,
+      Destination: rq.Origin,
+      HopLimit: 10,
+      HashValue: rq.HashValue,
+      Data: data,
+      Nonce: rq.Nonce,
+    }},
+  )
 }
 
 func (gossiper* Gossiper) ForwardDataRequest(rq *DataRequest) {
-  if rq.HopLimit > 0 {
-    gossiper.SendPacket(
-      gossiper.Router[rq.Destination],
-      &GossipPacket{nil, nil, nil, nil, rq, nil})
+  if rq.HopLimit == 0 {
+    return
+  }
+  if gossiper.Router[rq.Destination] == nil {
+    gossiper.QueuePacket(rq.Destination, &GossipPacket{DataRequest: rq}, time.Now().Add(OUTBOX_EXPIRY))
+    return
   }
-}
-
-func (gossiper* Gossiper) SendDataRequest(rq *DataRequest) {
   gossiper.SendPacket(
     gossiper.Router[rq.Destination],
-    &GossipPacket{nil, nil, nil, nil, rq, nil})
-  gossiper.DataRequestTimeouts[hex.EncodeToString(rq.HashValue)] = utils.SetTimeout(func() {
-    gossiper.SendDataRequest(rq)
-  }, time.Second * 5)
+    &GossipPacket{DataRequest: rq})
 }
 
 func (gossiper* Gossiper) ProcessDataReply(rp *DataReply) {
@@ -219,12 +374,22 @@ func (gossiper* Gossiper) ProcessDataReply(rp *DataReply) {
     fmt.Println("WRONG CHECKSUM")
     return
   }
-  if gossiper.DataRequestTimeouts[key] != nil {
-    close(gossiper.DataRequestTimeouts[key])
-    gossiper.DataRequestTimeouts[key] = nil
+  // Only what we asked for, from whom we asked it
+  pending := gossiper.DataRequests[rp.Nonce]
+  if pending == nil || pending.destination != rp.Origin || pending.hash != key {
+    fmt.Println("UNEXPECTED DataReply for", key, "from", rp.Origin)
+    return
+  }
+  gossiper.cancelDataRequest(rp.Nonce)
+  file := gossiper.Files[pending.file]
+  if file == nil {
+    return
   }
-  if gossiper.Files[key] != nil && gossiper.Files[key].Status == -1 {
-    var file *File = gossiper.Files[key]
+  if file.Status == -1 && key == pending.file {
+    if !IsValidMetaFile(rp.Data) {
+      fmt.Println("INVALID metafile of", file.FileName, "from", rp.Origin)
+      return
+    }
     // Fill in metafile
     file.MetaFile = rp.Data
     file.NumChunks = int64(len(rp.Data)) / int64(32)
@@ -236,52 +401,69 @@ func (gossiper* Gossiper) ProcessDataReply(rp *DataReply) {
       file.Chunks[hex.EncodeToString(hashSlice)] = []byte{}
     }
     file.Status = 0
-    // Request first chunk
-    gossiper.SendDataRequest(&DataRequest{
-      Origin: gossiper.Name,
-      Destination: rp.Origin,
-      HopLimit: 10,
-      HashValue: file.MetaFile[0:32],
-    })
+    if filled := gossiper.FillStoredChunks(file); filled > 0 {
+      fmt.Println("REUSING", filled, "chunks of", file.FileName, "held for other files")
+    }
+    // We can serve the chunks we get from now on, and want to know who else can
+    gossiper.AnnounceProvider(file.MetaHash)
+    gossiper.DiscoverChunkHolders(file, rp.Origin)
+    gossiper.requestNextChunk(file, rp.Origin)
   } else {
-    // Fill in unfilled file chunk
-    var file *File = nil
+    // Every file missing that chunk gets it, and moves on if it waited for it
+    data := gossiper.StoreChunk(key, rp.Data)
     for _, f := range gossiper.Files {
-      if f.Chunks[key] != nil && len(f.Chunks[key]) == 0 {
-        file = f
+      if chunk, ok := f.Chunks[key]; !ok || len(chunk) > 0 {
+        continue
+      }
+      f.Chunks[key] = data
+      before := f.Status
+      gossiper.FillStoredChunks(f)
+      if f.Status == before {
+        continue
       }
+      fmt.Println("DOWNLOADING", f.FileName, "chunk", f.Status, "from", rp.Origin)
+      if f != file {
+        gossiper.cancelDataRequests(hex.EncodeToString(f.MetaHash))
+      }
+      gossiper.requestNextChunk(f, rp.Origin)
     }
+  }
+}
 
-    if file != nil {
-      file.Chunks[key] = rp.Data
-      file.Status++
-      fmt.Println("DOWNLOADING", file.FileName, "chunk", file.Status, "from", rp.Origin)
-
-      if (file.Status == file.NumChunks) {
-        // Reconstruct the file locally when done downloading
-        file.Reconstruct()
+// Requests the next chunk of file if it is being downloaded, or completes
+// the download when no chunk is missing.
+func (gossiper* Gossiper) requestNextChunk(file *File, origin string) {
+  download := gossiper.Downloads[hex.EncodeToString(file.MetaHash)]
+  if file.Status == file.NumChunks {
+    if file.Directory {
+      if manifest, err := DecodeManifest(file.Data()); err != nil {
+        fmt.Println("INVALID manifest of", file.FileName, "from", origin + ":", err)
       } else {
-        offset := file.Status * 32
-        requested := file.MetaFile[offset:(offset + 32)]
-        // Request next chunk
-        gossiper.SendDataRequest(&DataRequest{
-          Origin: gossiper.Name,
-          Destination: rp.Origin,
-          HopLimit: 10,
-          HashValue: requested,
-        })
+        gossiper.DownloadTree(file, manifest, origin)
       }
     } else {
-      fmt.Println("DataReplyHandler: CAN'T FIND HASH", key)
+      file.Reconstruct(gossiper.DownloadDir)
+    }
+    gossiper.AnnounceProvider(file.MetaHash)
+    if download != nil {
+      gossiper.completeDownload(download)
     }
+    return
+  }
+  // Paused and cancelled downloads keep what they received
+  if download == nil || !download.IsActive() {
+    return
   }
+  download.Retries = 0
+  download.State = DOWNLOAD_CHUNKS
+  gossiper.requestDownload(download)
 }
 
 func (gossiper* Gossiper) ForwardDataReply(rp *DataReply) {
   if rp.HopLimit > 0 {
     gossiper.SendPacket(
       gossiper.Router[rp.Destination],
-      &GossipPacket{nil, nil, nil, nil, nil, rp})
+      &GossipPacket{DataReply: rp})
   }
 }
 
@@ -293,10 +475,85 @@ func (gossiper* Gossiper) GetMessage(origin string, id uint32) *RumorMessage {
   return gossiper.Rumors[origin][id]
 }
 
-func (gossiper* Gossiper) ShouldIgnoreRumor(rm *RumorMessage) bool {
+func (gossiper* Gossiper) IsRumorAhead(rm *RumorMessage) bool {
   return gossiper.GetNextIDForOrigin(rm.Origin) < rm.ID
 }
 
+// Keeps a rumor that arrived ahead of sequence until the gap before it is filled.
+// Returns false if the rumor was already buffered or the buffer is full.
+func (gossiper* Gossiper) BufferRumor(rm *RumorMessage, sender *net.UDPAddr) bool {
+  pending := gossiper.PendingRumors[rm.Origin]
+  if pending[rm.ID] != nil || len(pending) >= MAX_PENDING_RUMORS || gossiper.pendingRumorCount() >= MAX_PENDING_RUMORS_TOTAL {
+    return false
+  }
+  if pending == nil {
+    pending = make(map[uint32]*pendingRumor)
+    gossiper.PendingRumors[rm.Origin] = pending
+  }
+  pending[rm.ID] = &pendingRumor{rm, sender}
+  return true
+}
+
+func (gossiper* Gossiper) pendingRumorCount() int {
+  count := 0
+  for _, pending := range gossiper.PendingRumors {
+    count += len(pending)
+  }
+  return count
+}
+
+// Takes the buffered rumor of origin that is now in sequence, if any, with
+// who sent it. Buffered ones that arrived in sequence meanwhile are dropped.
+func (gossiper* Gossiper) NextPendingRumor(origin string) (*RumorMessage, *net.UDPAddr) {
+  pending := gossiper.PendingRumors[origin]
+  nextId := gossiper.GetNextIDForOrigin(origin)
+  next := pending[nextId]
+  for id := range pending {
+    if id <= nextId {
+      delete(pending, id)
+    }
+  }
+  if pending != nil && len(pending) == 0 {
+    delete(gossiper.PendingRumors, origin)
+  }
+  if next == nil {
+    return nil, nil
+  }
+  return next.rumor, next.sender
+}
+
+// Returns the IDs of origin's rumors before upTo that we neither have nor buffered.
+func (gossiper* Gossiper) MissingRumorIDs(origin string, upTo uint32) []uint32 {
+  var missing []uint32
+  for id := gossiper.GetNextIDForOrigin(origin); id < upTo && len(missing) < MAX_GAP_REQUEST_IDS; id++ {
+    if gossiper.PendingRumors[origin][id] == nil {
+      missing = append(missing, id)
+    }
+  }
+  return missing
+}
+
+func (gossiper* Gossiper) SendGapRequest(destination *net.UDPAddr, origin string, ids []uint32) {
+  if len(ids) == 0 {
+    return
+  }
+  gossiper.SendPacket(destination, &GossipPacket{Gap: &GapRequest{
+    Origin: origin,
+    IDs: ids,
+  }})
+}
+
+func (gossiper* Gossiper) ReplyGapRequest(sender *net.UDPAddr, gr *GapRequest) {
+  for i, id := range gr.IDs {
+    if i >= MAX_GAP_REQUEST_IDS {
+      break
+    }
+    if rm := gossiper.GetMessage(gr.Origin, id); rm != nil {
+      gossiper.SendPacket(sender, &GossipPacket{Rumor: rm})
+    }
+  }
+}
+
 func (gossiper* Gossiper) IsNewRumor(rm *RumorMessage) bool {
   return gossiper.GetNextIDForOrigin(rm.Origin) == rm.ID
 }
@@ -316,13 +573,13 @@ func (gossiper *Gossiper) GetNewRumorForPeer(peerPacket *StatusPacket) *RumorMes
   statusMap := peerPacket.ToMap()
   for origin := range gossiper.Rumors {
     nextId := gossiper.GetNextIDForOrigin(origin)
-    mapValue, exists := statusMap[origin]
-    if mapValue == nextId - 1 {
-      return gossiper.GetMessage(origin, nextId - 1)
+    peerNextId := statusMap[origin]
+    if peerNextId == 0 {
+      peerNextId = 1
     }
-    firstMessage := gossiper.GetMessage(origin, 1)
-    if !exists && firstMessage != nil {
-      return firstMessage
+    // Send the first rumor the peer is missing, however far behind it is
+    if peerNextId < nextId {
+      return gossiper.GetMessage(origin, peerNextId)
     }
   }
   return nil
@@ -331,7 +588,7 @@ func (gossiper *Gossiper) GetNewRumorForPeer(peerPacket *StatusPacket) *RumorMes
 func (gossiper *Gossiper) PeerHasRumors(peerPacket *StatusPacket) bool {
   statusMap := peerPacket.ToMap()
   for origin, nextId := range statusMap {
-    if gossiper.GetNextIDForOrigin(origin) == nextId - 1 {
+    if gossiper.GetNextIDForOrigin(origin) < nextId {
       return true
     }
   }
@@ -340,6 +597,9 @@ func (gossiper *Gossiper) PeerHasRumors(peerPacket *StatusPacket) bool {
 
 func (gossiper *Gossiper) ForwardToAllPeers(sender *net.UDPAddr, packet *GossipPacket) {
   for _, peer := range gossiper.Peers {
+    if sender != nil && peer.String() == sender.String() {
+      continue
+    }
     gossiper.SendPacket(peer, packet)
   }
 }
@@ -347,14 +607,32 @@ func (gossiper *Gossiper) ForwardToAllPeers(sender *net.UDPAddr, packet *GossipP
 func (gossiper *Gossiper) SendPacket(destination *net.UDPAddr, packet *GossipPacket) {
   packetBytes := EncodePacket(packet)
 
-  gossiper.Conn.WriteToUDP(packetBytes, destination)
+  if gossiper.Link != nil {
+    gossiper.Link.Send(destination, packetBytes, PacketPriority(packet))
+    return
+  }
+  gossiper.sendBytes(destination, packetBytes, PacketPriority(packet))
+}
+
+func (gossiper *Gossiper) sendBytes(destination *net.UDPAddr, data []byte, priority int) {
+  if gossiper.Scheduler != nil {
+    gossiper.Scheduler.Enqueue(destination, data, priority)
+    return
+  }
+  gossiper.Conn.WriteToUDP(data, destination)
 }
 
 func (gossiper *Gossiper) UpdateRoute(sender *net.UDPAddr, msg *RumorMessage) {
   // Guard from routing yourself
   if msg.Origin != gossiper.Name {
+    isNewOrigin := gossiper.Router[msg.Origin] == nil
     gossiper.Router[msg.Origin] = sender
+    gossiper.DHT.Add(msg.Origin)
     fmt.Println("DSDV", msg.Origin, sender.String())
+    if isNewOrigin {
+      gossiper.AnnounceProvidersTo(msg.Origin)
+    }
+    gossiper.FlushOutbox(msg.Origin)
   }
 }
 
@@ -364,7 +642,7 @@ func (gossiper *Gossiper) MongerRumor(msg *RumorMessage, exclude *net.UDPAddr, i
   }
   // Forward message to random peer
   destination := gossiper.RandomPeer(exclude)
-  gossiper.SendPacket(destination, &GossipPacket{nil, msg, nil, nil, nil, nil})
+  gossiper.SendPacket(destination, &GossipPacket{Rumor: msg})
   if isFlippedCoin {
     fmt.Println("FLIPPED COIN sending rumor to", destination.String())
   }
@@ -377,9 +655,12 @@ func (gossiper *Gossiper) MongerRumor(msg *RumorMessage, exclude *net.UDPAddr, i
 
 func (gossiper *Gossiper) SendRouteMessage() {
   rumor := &RumorMessage{
-    gossiper.Name,
-    gossiper.GetNextIDForOrigin(gossiper.Name),
-    "",
+    Origin: gossiper.Name,
+    ID: gossiper.GetNextIDForOrigin(gossiper.Name),
+    Text: "",
+    OnionKey: gossiper.OnionPublicKey(),
+    MailKey: gossiper.MailPublicKey(),
+    Mailbox: gossiper.IsMailbox,
   }
   gossiper.RecordRumor(rumor)
   gossiper.MongerRumor(rumor, nil, false)
@@ -409,26 +690,27 @@ func (gossiper *Gossiper) AddFile(fileName string, fileSize int64, metaHash [32]
     FileSize: fileSize,
     MetaHash: metaHash[:],
     MetaFile: metaFile,
-    NumChunks: int64(len(chunks)),
+    NumChunks: int64(len(metaFile) / 32),
     Chunks: chunks,
     Status: status,
   }
-  fmt.Println("UPLOADED file", key, "with", len(chunks), "chunks")
+  fmt.Println("UPLOADED file", key, "with", len(metaFile) / 32, "chunks,", len(chunks), "distinct")
+  gossiper.AnnounceProvider(metaHash[:])
 }
 
-func (file *File) Reconstruct() {
-  local, err := os.Create("_Downloads/" + file.FileName)
-  utils.CheckError(err)
-  defer local.Close()
-  fileSize := 0
-  for offset := 0; offset < len(file.MetaFile); offset += 32 {
-    hashSlice := file.MetaFile[offset:(offset + 32)]
-    n, err := local.Write(file.Chunks[hex.EncodeToString(hashSlice)]);
-    utils.CheckError(err)
-    fileSize += n
-  }
-  if file.FileSize != int64(fileSize) {
-    file.FileSize = int64(fileSize)
+func (file *File) IsComplete() bool {
+  return file.Status >= 0 && file.Status == file.NumChunks
+}
+
+func (file *File) Reconstruct(dir string) {
+  for _, name := range append([]string{file.FileName}, file.Copies...) {
+    written, err := file.writeDownload(dir, name, file.Mode)
+    if err != nil {
+      fmt.Println("Can't reconstruct", name + ":", err)
+      continue
+    }
+    fmt.Println("RECONSTRUCTED file", written)
   }
-  fmt.Println("RECONSTRUCTED file", file.FileName)
+  file.Copies = nil
+  file.FileSize = int64(len(file.Data()))
 }
@@ -0,0 +1,39 @@
+package types
+
+import (
+  "fmt"
+  "testing"
+)
+
+// Rumors ahead of sequence are buffered up to a cap over all origins, and
+// taken back in order once the gap before them is filled.
+func TestPendingRumors(t *testing.T) {
+  gossiper := NewGossiper("127.0.0.1:0", "A", "")
+  defer gossiper.Conn.Close()
+  for i := 0; i < MAX_PENDING_RUMORS_TOTAL; i++ {
+    if !gossiper.BufferRumor(&RumorMessage{Origin: fmt.Sprint("spoofed", i), ID: 2}, nil) {
+      t.Fatal("rumor", i, "refused below the cap")
+    }
+  }
+  if gossiper.BufferRumor(&RumorMessage{Origin: "B", ID: 3}, nil) || len(gossiper.PendingRumors["B"]) != 0 {
+    t.Error("rumor buffered past the cap")
+  }
+  gossiper.PendingRumors = make(map[string]map[uint32]*pendingRumor)
+
+  gossiper.BufferRumor(&RumorMessage{Origin: "B", ID: 3}, nil)
+  gossiper.BufferRumor(&RumorMessage{Origin: "B", ID: 2}, nil)
+  if next, _ := gossiper.NextPendingRumor("B"); next != nil {
+    t.Error("rumor", next.ID, "taken before the gap is filled")
+  }
+  gossiper.RecordRumor(&RumorMessage{Origin: "B", ID: 1})
+  for id := uint32(2); id <= 3; id++ {
+    next, _ := gossiper.NextPendingRumor("B")
+    if next == nil || next.ID != id {
+      t.Fatal("rumor", id, "not taken in sequence")
+    }
+    gossiper.RecordRumor(next)
+  }
+  if gossiper.PendingRumors["B"] != nil {
+    t.Error("empty buffer kept")
+  }
+}
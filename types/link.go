@@ -0,0 +1,470 @@
+package types
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "sort"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "strconv"
+  "strings"
+  "path/filepath"
+  "crypto/hmac"
+  "crypto/ecdh"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/ed25519"
+  "encoding/hex"
+  "encoding/binary"
+  "github.com/dedis/protobuf"
+)
+
+var LINK_HELLO_INTERVAL = time.Second // Between hellos to the same neighbor
+var LINK_HELLO_MAX_AGE = time.Minute // Hellos older than this are replays
+var LINK_REPLAY_WINDOW = uint64(2048) // Packets can be reordered by the send scheduler
+var MAX_LINKS = 1024
+var MAX_LINK_PENDING = 256 // Packets waiting for the handshake, per neighbor
+var LINK_IDENTITY_FILE = "link.key"
+
+// What goes on the wire when links are authenticated: either a handshake
+// message, or an encoded GossipPacket with its counter and MAC.
+type LinkFrame struct {
+  Hello *LinkHello
+  Restart bool // Asks for a hello, sent to neighbors whose frames we can't check
+  Counter uint64
+  Packet []byte
+  MAC []byte
+}
+
+// Carries an ephemeral X25519 key, authenticated with the pre-shared key,
+// the sender's identity key, or both. Bound to the address it is sent to, and
+// for responses to the hello they answer, so it can't be replayed elsewhere.
+type LinkHello struct {
+  Ephemeral []byte
+  Timestamp int64 // Unix nanoseconds, increasing
+  Response bool // Answers a hello, so must not be answered
+  Recipient string // ip:port the hello is sent to
+  Peer []byte // For responses, the ephemeral key of the hello answered
+  MAC []byte // With the pre-shared key
+  PublicKey []byte // Ed25519 identity of the sender
+  Signature []byte
+}
+
+type replayWindow struct {
+  highest uint64
+  seen []bool // Indexed by counter modulo LINK_REPLAY_WINDOW
+}
+
+// State of the link with one neighbor address.
+type link struct {
+  ephemeral *ecdh.PrivateKey // Ours, kept for the lifetime of the link
+  theirs []byte // Their ephemeral public key, nil until the handshake is done
+  sendKey []byte
+  recvKey []byte
+  sendCounter uint64
+  recv *replayWindow
+  lastHello int64 // Timestamp of the last hello accepted from them
+  helloSent time.Time
+  pending []*pendingFrame
+  used time.Time
+}
+
+type pendingFrame struct {
+  data []byte
+  priority int
+}
+
+// Authenticates every packet between direct neighbors. Neighbors handshake
+// on first contact, and packets without a valid MAC are dropped.
+type LinkAuth struct {
+  lock sync.Mutex
+  psk []byte // Network-wide pre-shared key, nil if unused
+  identity ed25519.PrivateKey // Nil if keys aren't used
+  trusted map[string]bool // Hex identity keys we accept, if identity is set
+  links map[string]*link
+  self *net.UDPAddr // Where we listen, that hellos must be sent to
+  send func(*net.UDPAddr, []byte, int)
+}
+
+// A LinkAuth with a pre-shared key, and identity keys when trusted isn't
+// empty. At least one of them must be given.
+func NewLinkAuth(psk string, identity ed25519.PrivateKey, trusted []string) (*LinkAuth, error) {
+  auth := &LinkAuth{trusted: make(map[string]bool), links: make(map[string]*link)}
+  if psk != "" {
+    auth.psk = []byte(psk)
+  }
+  for _, key := range trusted {
+    key = strings.TrimSpace(key)
+    if decoded, err := hex.DecodeString(key); err != nil || len(decoded) != ed25519.PublicKeySize {
+      return nil, fmt.Errorf("invalid trusted key %q", key)
+    }
+    auth.trusted[strings.ToLower(key)] = true
+  }
+  if len(auth.trusted) > 0 {
+    auth.identity = identity
+  }
+  if auth.psk == nil && auth.identity == nil {
+    return nil, errors.New("link authentication needs a pre-shared key or trusted keys")
+  }
+  return auth, nil
+}
+
+// Reads the Ed25519 identity key of dir, creating it if there is none yet.
+func LoadOrCreateLinkIdentity(dir string) (ed25519.PrivateKey, error) {
+  path := filepath.Join(dir, LINK_IDENTITY_FILE)
+  data, err := os.ReadFile(path)
+  if err == nil {
+    seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(seed) != ed25519.SeedSize {
+      return nil, fmt.Errorf("corrupted identity key %s", path)
+    }
+    return ed25519.NewKeyFromSeed(seed), nil
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+  _, key, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())), 0600)
+}
+
+func (auth *LinkAuth) PublicKey() string {
+  if auth.identity == nil {
+    return ""
+  }
+  return hex.EncodeToString(auth.identity.Public().(ed25519.PublicKey))
+}
+
+// Neighbors we share keys with, sorted.
+func (auth *LinkAuth) Established() []string {
+  auth.lock.Lock()
+  defer auth.lock.Unlock()
+  list := make([]string, 0, len(auth.links))
+  for address, l := range auth.links {
+    if l.theirs != nil {
+      list = append(list, address)
+    }
+  }
+  sort.Strings(list)
+  return list
+}
+
+// Returns the link with address, creating it. The least recently used link
+// is forgotten if there are too many.
+func (auth *LinkAuth) linkTo(address string) *link {
+  l := auth.links[address]
+  if l == nil {
+    if len(auth.links) >= MAX_LINKS {
+      oldest := ""
+      for other, ol := range auth.links {
+        if oldest == "" || ol.used.Before(auth.links[oldest].used) {
+          oldest = other
+        }
+      }
+      delete(auth.links, oldest)
+    }
+    key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+    l = &link{ephemeral: key}
+    auth.links[address] = l
+  }
+  l.used = time.Now()
+  return l
+}
+
+func (w *replayWindow) accept(counter uint64) bool {
+  if counter == 0 || counter + LINK_REPLAY_WINDOW <= w.highest {
+    return false
+  }
+  slot := counter % LINK_REPLAY_WINDOW
+  if counter > w.highest {
+    for c := w.highest + 1; c < counter && c <= w.highest + LINK_REPLAY_WINDOW; c++ {
+      w.seen[c % LINK_REPLAY_WINDOW] = false
+    }
+    w.highest = counter
+    w.seen[slot] = true
+    return true
+  }
+  if w.seen[slot] {
+    return false
+  }
+  w.seen[slot] = true
+  return true
+}
+
+func helloTranscript(hello *LinkHello) []byte {
+  var transcript bytes.Buffer
+  transcript.WriteString("peerster link hello")
+  transcript.Write(hello.Ephemeral)
+  binary.Write(&transcript, binary.BigEndian, hello.Timestamp)
+  binary.Write(&transcript, binary.BigEndian, hello.Response)
+  binary.Write(&transcript, binary.BigEndian, uint32(len(hello.Recipient)))
+  transcript.WriteString(hello.Recipient)
+  binary.Write(&transcript, binary.BigEndian, uint32(len(hello.Peer)))
+  transcript.Write(hello.Peer)
+  transcript.Write(hello.PublicKey)
+  return transcript.Bytes()
+}
+
+// Whether a hello sent to recipient was meant for us. Any address of ours
+// matches if we listen on all of them.
+func (auth *LinkAuth) isSelf(recipient string) bool {
+  host, port, err := net.SplitHostPort(recipient)
+  if err != nil || auth.self == nil || port != strconv.Itoa(auth.self.Port) {
+    return false
+  }
+  ip := net.ParseIP(host)
+  return ip != nil && (auth.self.IP.IsUnspecified() || auth.self.IP.Equal(ip))
+}
+
+func mac(key []byte, parts ...[]byte) []byte {
+  h := hmac.New(sha256.New, key)
+  for _, part := range parts {
+    h.Write(part)
+  }
+  return h.Sum(nil)
+}
+
+func (auth *LinkAuth) newHello(l *link, to *net.UDPAddr, response bool) []byte {
+  hello := &LinkHello{
+    Ephemeral: l.ephemeral.PublicKey().Bytes(),
+    Timestamp: time.Now().UnixNano(),
+    Response: response,
+    Recipient: to.String(),
+  }
+  if response {
+    hello.Peer = l.theirs
+  }
+  if auth.identity != nil {
+    hello.PublicKey = auth.identity.Public().(ed25519.PublicKey)
+  }
+  transcript := helloTranscript(hello)
+  if auth.psk != nil {
+    hello.MAC = mac(auth.psk, transcript)
+  }
+  if auth.identity != nil {
+    hello.Signature = ed25519.Sign(auth.identity, transcript)
+  }
+  l.helloSent = time.Now()
+  data, _ := protobuf.Encode(&LinkFrame{Hello: hello})
+  return data
+}
+
+func (auth *LinkAuth) checkHello(hello *LinkHello) *InvalidPacketError {
+  if len(hello.Ephemeral) != 32 {
+    return invalid("LinkHello", "ephemeral key has %d bytes instead of 32", len(hello.Ephemeral))
+  }
+  age := time.Since(time.Unix(0, hello.Timestamp))
+  if age > LINK_HELLO_MAX_AGE || age < -LINK_HELLO_MAX_AGE {
+    return invalid("LinkHello", "timestamp is %v off", age)
+  }
+  if !auth.isSelf(hello.Recipient) {
+    return invalid("LinkHello", "sent to %q, not to us", hello.Recipient)
+  }
+  transcript := helloTranscript(hello)
+  if auth.psk != nil && !hmac.Equal(hello.MAC, mac(auth.psk, transcript)) {
+    return invalid("LinkHello", "wrong pre-shared key")
+  }
+  if auth.identity != nil {
+    if len(hello.PublicKey) != ed25519.PublicKeySize || !auth.trusted[hex.EncodeToString(hello.PublicKey)] {
+      return invalid("LinkHello", "untrusted identity key")
+    }
+    if !ed25519.Verify(hello.PublicKey, transcript, hello.Signature) {
+      return invalid("LinkHello", "bad signature")
+    }
+  }
+  return nil
+}
+
+// Derives a key per direction from the X25519 secret, mixed with the
+// pre-shared key, so frames can't be reflected back to their sender.
+func (auth *LinkAuth) deriveKeys(l *link, theirs []byte) error {
+  public, err := ecdh.X25519().NewPublicKey(theirs)
+  if err != nil {
+    return err
+  }
+  secret, err := l.ephemeral.ECDH(public)
+  if err != nil {
+    return err
+  }
+  master := mac(append([]byte("peerster link key"), auth.psk...), secret)
+  ours := l.ephemeral.PublicKey().Bytes()
+  l.sendKey = mac(master, ours, theirs)
+  l.recvKey = mac(master, theirs, ours)
+  l.theirs = theirs
+  l.sendCounter = 0
+  l.recv = &replayWindow{seen: make([]bool, LINK_REPLAY_WINDOW)}
+  return nil
+}
+
+func (l *link) seal(data []byte) []byte {
+  l.sendCounter++
+  counter := make([]byte, 8)
+  binary.BigEndian.PutUint64(counter, l.sendCounter)
+  frame, _ := protobuf.Encode(&LinkFrame{
+    Counter: l.sendCounter,
+    Packet: data,
+    MAC: mac(l.sendKey, counter, data),
+  })
+  return frame
+}
+
+// Sends an encoded packet once the link with destination is up, starting the
+// handshake if it isn't.
+func (auth *LinkAuth) Send(destination *net.UDPAddr, data []byte, priority int) {
+  auth.lock.Lock()
+  l := auth.linkTo(destination.String())
+  if l.theirs != nil {
+    frame := l.seal(data)
+    auth.lock.Unlock()
+    auth.send(destination, frame, priority)
+    return
+  }
+  if len(l.pending) >= MAX_LINK_PENDING {
+    l.pending = l.pending[1:]
+  }
+  l.pending = append(l.pending, &pendingFrame{data, priority})
+  var hello []byte
+  if time.Since(l.helloSent) >= LINK_HELLO_INTERVAL {
+    hello = auth.newHello(l, destination, false)
+  }
+  auth.lock.Unlock()
+  if hello != nil {
+    auth.send(destination, hello, PRIORITY_CONTROL)
+  }
+}
+
+// Sends a new hello to address if we have a link with it, and didn't send one
+// recently.
+func (auth *LinkAuth) resendHello(address *net.UDPAddr) {
+  auth.lock.Lock()
+  var hello []byte
+  if l := auth.links[address.String()]; l != nil && time.Since(l.helloSent) >= LINK_HELLO_INTERVAL {
+    hello = auth.newHello(l, address, false)
+  }
+  auth.lock.Unlock()
+  if hello != nil {
+    auth.send(address, hello, PRIORITY_CONTROL)
+  }
+}
+
+// Checks a frame from sender, returns the packet it carries, or nil for
+// handshake frames.
+func (auth *LinkAuth) Open(data []byte, sender *net.UDPAddr) ([]byte, *InvalidPacketError) {
+  var frame LinkFrame
+  if err := protobuf.Decode(data, &frame); err != nil {
+    return nil, invalid("undecodable", "not a LinkFrame")
+  }
+  if frame.Hello != nil {
+    return nil, auth.receiveHello(frame.Hello, sender)
+  }
+  if frame.Restart {
+    auth.resendHello(sender)
+    return nil, nil
+  }
+
+  auth.lock.Lock()
+  l := auth.links[sender.String()]
+  if l == nil || l.theirs == nil {
+    auth.lock.Unlock()
+    // They may have a link with a previous run of ours, so ask them to
+    // handshake again. Nothing is kept until their hello is authenticated.
+    if l == nil {
+      restart, _ := protobuf.Encode(&LinkFrame{Restart: true})
+      auth.send(sender, restart, PRIORITY_CONTROL)
+    } else {
+      auth.resendHello(sender)
+    }
+    return nil, invalid("unauthenticated", "no link with %s", sender.String())
+  }
+  defer auth.lock.Unlock()
+  counter := make([]byte, 8)
+  binary.BigEndian.PutUint64(counter, frame.Counter)
+  if !hmac.Equal(frame.MAC, mac(l.recvKey, counter, frame.Packet)) {
+    return nil, invalid("unauthenticated", "bad MAC")
+  }
+  if !l.recv.accept(frame.Counter) {
+    return nil, invalid("replayed", "counter %d was already used or is too old", frame.Counter)
+  }
+  l.used = time.Now()
+  return frame.Packet, nil
+}
+
+// Completes the handshake with sender, answers the hello if it isn't an
+// answer itself, and sends the packets that waited for the link.
+func (auth *LinkAuth) receiveHello(hello *LinkHello, sender *net.UDPAddr) *InvalidPacketError {
+  if err := auth.checkHello(hello); err != nil {
+    return err
+  }
+  auth.lock.Lock()
+  if hello.Response {
+    // Only answers to the hello of a link we have are expected
+    l := auth.links[sender.String()]
+    if l == nil || !bytes.Equal(hello.Peer, l.ephemeral.PublicKey().Bytes()) {
+      auth.lock.Unlock()
+      return invalid("LinkHello", "answers a hello we didn't send")
+    }
+  }
+  l := auth.linkTo(sender.String())
+  isNew := !bytes.Equal(hello.Ephemeral, l.theirs)
+  if isNew && hello.Timestamp <= l.lastHello {
+    auth.lock.Unlock()
+    return invalid("replayed", "hello is older than the last one")
+  }
+  var frames [][]byte
+  var priorities []int
+  if isNew {
+    if err := auth.deriveKeys(l, hello.Ephemeral); err != nil {
+      auth.lock.Unlock()
+      return invalid("LinkHello", "%v", err)
+    }
+    fmt.Println("LINK established with", sender.String())
+  }
+  if hello.Timestamp > l.lastHello {
+    l.lastHello = hello.Timestamp
+  }
+  if !hello.Response && (isNew || time.Since(l.helloSent) >= LINK_HELLO_INTERVAL) {
+    frames = append(frames, auth.newHello(l, sender, true))
+    priorities = append(priorities, PRIORITY_CONTROL)
+  }
+  for _, pending := range l.pending {
+    frames = append(frames, l.seal(pending.data))
+    priorities = append(priorities, pending.priority)
+  }
+  l.pending = nil
+  auth.lock.Unlock()
+
+  for i, frame := range frames {
+    auth.send(sender, frame, priorities[i])
+  }
+  return nil
+}
+
+// Authenticates the links with neighbors from now on.
+func (gossiper *Gossiper) EnableLinkAuth(auth *LinkAuth) {
+  auth.send = gossiper.sendBytes
+  auth.self = gossiper.Address
+  gossiper.Link = auth
+}
+
+// Reads a packet received from sender, through its link if links are
+// authenticated. Returns a nil packet and no error for handshake frames.
+func (gossiper *Gossiper) OpenPacket(data []byte, sender *net.UDPAddr) (*GossipPacket, *InvalidPacketError) {
+  if gossiper.Link != nil {
+    var err *InvalidPacketError
+    if data, err = gossiper.Link.Open(data, sender); data == nil {
+      return nil, err
+    }
+  }
+  var packet GossipPacket
+  if err := protobuf.Decode(data, &packet); err != nil {
+    return nil, invalid("undecodable", "not a GossipPacket")
+  }
+  return &packet, nil
+}
@@ -0,0 +1,122 @@
+package types
+
+import (
+  "fmt"
+  "path"
+  "bytes"
+  "errors"
+  "encoding/hex"
+  "encoding/json"
+)
+
+// Starts the content of manifests. A file is only taken for one when it was
+// requested as a directory, as any shared file may start like this.
+var MANIFEST_MAGIC = []byte("PEERSTER-MANIFEST 1\n")
+var MAX_MANIFEST_ENTRIES = 10000
+
+// A file of a shared directory tree.
+type ManifestEntry struct {
+  Path string // Relative to the directory, slash separated
+  Mode uint32 // Permission bits, 0 if unknown
+  Size int64
+  MetaHash []byte
+}
+
+// Lists the files of a shared directory tree. It is shared like any other
+// file, and downloading it downloads every file it lists.
+type Manifest struct {
+  Entries []*ManifestEntry
+}
+
+func EncodeManifest(manifest *Manifest) []byte {
+  data, _ := json.Marshal(manifest)
+  return append(append([]byte{}, MANIFEST_MAGIC...), data...)
+}
+
+func IsManifest(data []byte) bool {
+  return bytes.HasPrefix(data, MANIFEST_MAGIC)
+}
+
+// Decodes a manifest from a peer, making sure every path stays inside the
+// directory it is downloaded to.
+func DecodeManifest(data []byte) (*Manifest, error) {
+  if !IsManifest(data) {
+    return nil, errors.New("not a manifest")
+  }
+  var manifest Manifest
+  if err := json.Unmarshal(data[len(MANIFEST_MAGIC):], &manifest); err != nil {
+    return nil, err
+  }
+  if len(manifest.Entries) == 0 || len(manifest.Entries) > MAX_MANIFEST_ENTRIES {
+    return nil, fmt.Errorf("%d entries", len(manifest.Entries))
+  }
+  paths := make(map[string]bool)
+  for _, entry := range manifest.Entries {
+    if err := SafePath(entry.Path); err != nil {
+      return nil, err
+    }
+    if len(entry.MetaHash) != 32 || entry.Size < 0 || entry.Mode & ^uint32(0777) != 0 {
+      return nil, fmt.Errorf("invalid entry %s", entry.Path)
+    }
+    if paths[entry.Path] {
+      return nil, fmt.Errorf("%s is listed twice", entry.Path)
+    }
+    paths[entry.Path] = true
+  }
+  for _, entry := range manifest.Entries {
+    for parent := path.Dir(entry.Path); parent != "."; parent = path.Dir(parent) {
+      if paths[parent] {
+        return nil, fmt.Errorf("%s is listed as a file and a directory", parent)
+      }
+    }
+  }
+  return &manifest, nil
+}
+
+// Content of a file we hold all chunks of.
+func (file *File) Data() []byte {
+  var data []byte
+  for offset := 0; offset < len(file.MetaFile); offset += 32 {
+    data = append(data, file.Chunks[hex.EncodeToString(file.MetaFile[offset:offset + 32])]...)
+  }
+  return data
+}
+
+// Downloads the files listed by the manifest of tree from origin, into a
+// directory named like tree. Files we already hold are written right away.
+func (gossiper *Gossiper) DownloadTree(tree *File, manifest *Manifest, origin string) {
+  root, err := makeDownloadDir(gossiper.DownloadDir, tree.FileName)
+  if err != nil {
+    fmt.Println("REFUSING to download", tree.FileName + ":", err)
+    return
+  }
+  fmt.Println("DOWNLOADING directory", root, "with", len(manifest.Entries), "files from", origin)
+  // Its files are queued like the directory was
+  priority := 0
+  if download := gossiper.Downloads[hex.EncodeToString(tree.MetaHash)]; download != nil {
+    priority = download.Priority
+  }
+  for _, entry := range manifest.Entries {
+    name := path.Join(root, entry.Path)
+    key := hex.EncodeToString(entry.MetaHash)
+    file := gossiper.Files[key]
+    switch {
+    case entry.Size == 0:
+      (&File{FileName: name, FileSize: 0, Mode: entry.Mode}).Reconstruct(gossiper.DownloadDir)
+    case file != nil && file.IsComplete():
+      if _, err := file.writeDownload(gossiper.DownloadDir, name, entry.Mode); err != nil {
+        fmt.Println("Can't reconstruct", name + ":", err)
+      }
+    case file != nil:
+      // Written there too once complete, so a paused or failed download of
+      // it is queued again
+      if download := gossiper.Downloads[key]; download == nil || !download.IsActive() && download.State != DOWNLOAD_QUEUED {
+        gossiper.QueueDownload(entry.MetaHash, file.FileName, origin, priority, false)
+      }
+      gossiper.Files[key].Copies = append(gossiper.Files[key].Copies, name)
+    default:
+      gossiper.QueueDownload(entry.MetaHash, name, origin, priority, false)
+      gossiper.Files[key].Mode = entry.Mode
+    }
+  }
+}
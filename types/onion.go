@@ -0,0 +1,494 @@
+package types
+
+import (
+  "os"
+  "fmt"
+  "time"
+  "bytes"
+  "errors"
+  "math/rand"
+  "path/filepath"
+  "crypto/aes"
+  "crypto/ecdh"
+  "crypto/hmac"
+  "crypto/cipher"
+  "crypto/sha256"
+  crand "crypto/rand"
+  "encoding/hex"
+  "encoding/binary"
+  "github.com/dedis/protobuf"
+)
+
+var ONION_HOPS = 3 // Default of Gossiper.OnionHops
+var ONION_CIRCUIT_TTL = 10 * time.Minute
+var MAX_ONION_CIRCUITS = 4096 // Per kind of circuit state
+var ONION_KEY_FILE = "onion.key"
+var ONION_KEY_SIZE = 32
+
+// Travels along a circuit. Routers only see the next hop, hops only see the
+// previous and next ones, and only the destination sees the message.
+type OnionPacket struct {
+  Destination string // Next hop of the circuit
+  HopLimit uint32
+  Circuit uint64 // Identifies the circuit on the segment leading to Destination
+  Backward bool // From the destination back to the sender
+  Data []byte
+}
+
+// What a hop decrypts from the Data of a forward OnionPacket.
+type OnionLayer struct {
+  Previous string // Hop replies are sent back to
+  Next string // Empty at the destination
+  NextCircuit uint64
+  Key []byte // Encrypts replies on their way back through this hop
+  Inner []byte // Data for Next
+  Payload *OnionPayload // At the destination only
+  Auth []byte // With Payload, proves the origin holds its onion key
+}
+
+type OnionPayload struct {
+  Message *PrivateMessage
+  Ack *PrivateAck
+}
+
+// A circuit we built, to peel the replies that come back over it.
+type onionCircuit struct {
+  destination string
+  keys [][]byte // Of each hop, then of the destination
+  expires time.Time
+}
+
+// Where a hop, or the destination, sends replies coming back over a circuit.
+type onionReturn struct {
+  previous string
+  circuit uint64
+  key []byte
+  expires time.Time
+}
+
+// Reads the X25519 onion key of dir, creating it if there is none yet. It is
+// kept across restarts, as peers learn it from route rumors they won't repeat.
+func LoadOrCreateOnionKey(dir string) (*ecdh.PrivateKey, error) {
+  return loadOrCreateX25519Key(filepath.Join(dir, ONION_KEY_FILE))
+}
+
+func loadOrCreateX25519Key(path string) (*ecdh.PrivateKey, error) {
+  dir := filepath.Dir(path)
+  data, err := os.ReadFile(path)
+  if err == nil {
+    raw, err := hex.DecodeString(string(data))
+    if err != nil {
+      return nil, fmt.Errorf("corrupted key %s", path)
+    }
+    return ecdh.X25519().NewPrivateKey(raw)
+  } else if !os.IsNotExist(err) {
+    return nil, err
+  }
+  key, err := ecdh.X25519().GenerateKey(crand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Bytes())), 0600)
+}
+
+// Our public onion key, advertised in our route rumors.
+func (gossiper *Gossiper) OnionPublicKey() []byte {
+  if gossiper.OnionKey == nil {
+    return nil
+  }
+  return gossiper.OnionKey.PublicKey().Bytes()
+}
+
+func sealSymmetric(key, plaintext []byte) []byte {
+  block, _ := aes.NewCipher(key)
+  gcm, _ := cipher.NewGCM(block)
+  nonce := make([]byte, gcm.NonceSize())
+  crand.Read(nonce)
+  return gcm.Seal(nonce, nonce, plaintext, nil)
+}
+
+func openSymmetric(key, data []byte) ([]byte, error) {
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  gcm, _ := cipher.NewGCM(block)
+  if len(data) < gcm.NonceSize() {
+    return nil, errors.New("truncated ciphertext")
+  }
+  return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func sealedKey(label string, secret, ephemeral []byte) []byte {
+  hash := sha256.New()
+  hash.Write([]byte(label))
+  hash.Write(secret)
+  hash.Write(ephemeral)
+  return hash.Sum(nil)
+}
+
+// Encrypts plaintext for the holder of the X25519 key public, with an
+// ephemeral key sent ahead of it. label keeps keys of different uses apart.
+func sealTo(public []byte, label string, plaintext []byte) ([]byte, error) {
+  recipient, err := ecdh.X25519().NewPublicKey(public)
+  if err != nil {
+    return nil, err
+  }
+  ephemeral, err := ecdh.X25519().GenerateKey(crand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  secret, err := ephemeral.ECDH(recipient)
+  if err != nil {
+    return nil, err
+  }
+  ephemeralBytes := ephemeral.PublicKey().Bytes()
+  return append(ephemeralBytes, sealSymmetric(sealedKey(label, secret, ephemeralBytes), plaintext)...), nil
+}
+
+// Decrypts what sealTo encrypted for the public key of key.
+func openSealed(key *ecdh.PrivateKey, label string, data []byte) ([]byte, error) {
+  if len(data) < ONION_KEY_SIZE {
+    return nil, errors.New("truncated ciphertext")
+  }
+  ephemeral, err := ecdh.X25519().NewPublicKey(data[:ONION_KEY_SIZE])
+  if err != nil {
+    return nil, err
+  }
+  secret, err := key.ECDH(ephemeral)
+  if err != nil {
+    return nil, err
+  }
+  return openSymmetric(sealedKey(label, secret, data[:ONION_KEY_SIZE]), data[ONION_KEY_SIZE:])
+}
+
+// Key shared by the holders of two onion keys, without exchanging anything.
+func (gossiper *Gossiper) onionAuthKey(origin string) ([]byte, error) {
+  if gossiper.OnionKey == nil || gossiper.OnionKeys[origin] == nil {
+    return nil, fmt.Errorf("no onion key is known for %s", origin)
+  }
+  public, err := ecdh.X25519().NewPublicKey(gossiper.OnionKeys[origin])
+  if err != nil {
+    return nil, err
+  }
+  secret, err := gossiper.OnionKey.ECDH(public)
+  if err != nil {
+    return nil, err
+  }
+  return sealedKey("peerster onion auth", secret, nil), nil
+}
+
+// What the origin of a payload authenticates: the payload, and the circuit
+// replies go back over, so neither can be swapped.
+func onionAuthTranscript(circuit uint64, layer *OnionLayer) []byte {
+  var transcript bytes.Buffer
+  field := func(data string) {
+    binary.Write(&transcript, binary.BigEndian, uint32(len(data)))
+    transcript.WriteString(data)
+  }
+  transcript.WriteString("peerster onion payload")
+  binary.Write(&transcript, binary.BigEndian, circuit)
+  field(layer.Previous)
+  field(string(layer.Key))
+  if pm := layer.Payload.Message; pm != nil {
+    field(pm.Origin)
+    field(pm.Destination)
+    binary.Write(&transcript, binary.BigEndian, pm.ID)
+    field(pm.Text)
+  }
+  if ack := layer.Payload.Ack; ack != nil {
+    field(ack.Origin)
+    field(ack.Destination)
+    binary.Write(&transcript, binary.BigEndian, ack.ID)
+  }
+  return transcript.Bytes()
+}
+
+// Encrypts a layer for the holder of public.
+func sealLayer(public []byte, layer *OnionLayer) ([]byte, error) {
+  plaintext, err := protobuf.Encode(layer)
+  if err != nil {
+    return nil, err
+  }
+  return sealTo(public, "peerster onion layer", plaintext)
+}
+
+func (gossiper *Gossiper) openLayer(data []byte) (*OnionLayer, error) {
+  plaintext, err := openSealed(gossiper.OnionKey, "peerster onion layer", data)
+  if err != nil {
+    return nil, err
+  }
+  var layer OnionLayer
+  if err := protobuf.Decode(plaintext, &layer); err != nil {
+    return nil, err
+  }
+  if len(layer.Key) != 32 || layer.Previous == "" {
+    return nil, errors.New("malformed layer")
+  }
+  return &layer, nil
+}
+
+// Relays for a circuit to destination: OnionHops reachable origins whose
+// onion key we know. Fails rather than build a shorter circuit.
+func (gossiper *Gossiper) pickOnionHops(destination string) ([]string, error) {
+  var candidates []string
+  for origin, key := range gossiper.OnionKeys {
+    if origin != destination && origin != gossiper.Name && key != nil && gossiper.Router[origin] != nil {
+      candidates = append(candidates, origin)
+    }
+  }
+  if len(candidates) < gossiper.OnionHops {
+    return nil, fmt.Errorf("%d relays are known, %d are needed", len(candidates), gossiper.OnionHops)
+  }
+  rand.Shuffle(len(candidates), func(i, j int) {
+    candidates[i], candidates[j] = candidates[j], candidates[i]
+  })
+  return candidates[:gossiper.OnionHops], nil
+}
+
+func randomKey() []byte {
+  key := make([]byte, 32)
+  crand.Read(key)
+  return key
+}
+
+// Drops expired circuit state, and arbitrary entries while there are too many.
+func (gossiper *Gossiper) pruneOnionState() {
+  now := time.Now()
+  for id, circuit := range gossiper.OnionCircuits {
+    if now.After(circuit.expires) || len(gossiper.OnionCircuits) > MAX_ONION_CIRCUITS {
+      delete(gossiper.OnionCircuits, id)
+    }
+  }
+  for id, back := range gossiper.OnionRelays {
+    if now.After(back.expires) || len(gossiper.OnionRelays) > MAX_ONION_CIRCUITS {
+      delete(gossiper.OnionRelays, id)
+    }
+  }
+  for origin, back := range gossiper.OnionReplies {
+    if now.After(back.expires) || len(gossiper.OnionReplies) > MAX_ONION_CIRCUITS {
+      delete(gossiper.OnionReplies, origin)
+    }
+  }
+}
+
+// Wraps payload for destination in a layer per hop of a new circuit, and
+// sends it to the first hop.
+func (gossiper *Gossiper) SendOnion(destination string, payload *OnionPayload) error {
+  if gossiper.OnionKeys[destination] == nil {
+    return fmt.Errorf("no onion key is known for %s", destination)
+  }
+  hops, err := gossiper.pickOnionHops(destination)
+  if err != nil {
+    return err
+  }
+  path := append(hops, destination)
+  keys := make([][]byte, len(path))
+  circuits := make([]uint64, len(path)) // Of the segment leading to each hop
+  for i := range path {
+    keys[i] = randomKey()
+    circuits[i] = rand.Uint64() | 1
+  }
+  previous := func(i int) string {
+    if i == 0 {
+      return gossiper.Name
+    }
+    return path[i - 1]
+  }
+
+  last := len(path) - 1
+  auth, err := gossiper.onionAuthKey(destination)
+  if err != nil {
+    return err
+  }
+  layer := &OnionLayer{
+    Previous: previous(last),
+    Key: keys[last],
+    Payload: payload,
+  }
+  layer.Auth = mac(auth, onionAuthTranscript(circuits[last], layer))
+  data, err := sealLayer(gossiper.OnionKeys[destination], layer)
+  for i := last - 1; i >= 0 && err == nil; i-- {
+    data, err = sealLayer(gossiper.OnionKeys[path[i]], &OnionLayer{
+      Previous: previous(i),
+      Next: path[i + 1],
+      NextCircuit: circuits[i + 1],
+      Key: keys[i],
+      Inner: data,
+    })
+  }
+  if err != nil {
+    return err
+  }
+
+  gossiper.pruneOnionState()
+  gossiper.OnionCircuits[circuits[0]] = &onionCircuit{destination, keys, time.Now().Add(ONION_CIRCUIT_TTL)}
+  fmt.Println("ONION circuit to", destination, "through", len(path) - 1, "hops")
+  gossiper.ForwardOnion(&OnionPacket{
+    Destination: path[0],
+    HopLimit: 10,
+    Circuit: circuits[0],
+    Data: data,
+  })
+  return nil
+}
+
+// Whether we can reach destination over a circuit, built by us or by them.
+func (gossiper *Gossiper) CanOnion(destination string) bool {
+  back := gossiper.OnionReplies[destination]
+  return gossiper.OnionKeys[destination] != nil || back != nil && time.Now().Before(back.expires)
+}
+
+// Sends payload back over the circuit origin last reached us with.
+func (gossiper *Gossiper) ReplyOnion(origin string, payload *OnionPayload) bool {
+  back := gossiper.OnionReplies[origin]
+  if back == nil || time.Now().After(back.expires) {
+    return false
+  }
+  plaintext, err := protobuf.Encode(payload)
+  if err != nil {
+    return false
+  }
+  gossiper.ForwardOnion(&OnionPacket{
+    Destination: back.previous,
+    HopLimit: 10,
+    Circuit: back.circuit,
+    Backward: true,
+    Data: sealSymmetric(back.key, plaintext),
+  })
+  return true
+}
+
+func (gossiper *Gossiper) ForwardOnion(packet *OnionPacket) {
+  if gossiper.Router[packet.Destination] == nil {
+    fmt.Println("ONION dropped, no route to", packet.Destination)
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[packet.Destination], &GossipPacket{Onion: packet})
+}
+
+// Handles an onion packet addressed to us: peels a forward layer and passes
+// the rest on, adds our layer to a reply, or reads what reached its end.
+func (gossiper *Gossiper) ReceiveOnion(packet *OnionPacket) error {
+  if packet.Backward {
+    if circuit := gossiper.OnionCircuits[packet.Circuit]; circuit != nil {
+      return gossiper.receiveOnionReply(circuit, packet.Data)
+    }
+    back := gossiper.OnionRelays[packet.Circuit]
+    if back == nil {
+      return errors.New("unknown circuit")
+    }
+    gossiper.ForwardOnion(&OnionPacket{
+      Destination: back.previous,
+      HopLimit: 10,
+      Circuit: back.circuit,
+      Backward: true,
+      Data: sealSymmetric(back.key, packet.Data),
+    })
+    return nil
+  }
+
+  if gossiper.OnionKey == nil {
+    return errors.New("onion routing is disabled")
+  }
+  layer, err := gossiper.openLayer(packet.Data)
+  if err != nil {
+    return err
+  }
+  back := &onionReturn{layer.Previous, packet.Circuit, layer.Key, time.Now().Add(ONION_CIRCUIT_TTL)}
+  if layer.Payload != nil {
+    return gossiper.receiveOnionPayload(layer, back)
+  }
+  if layer.Next == "" {
+    return errors.New("layer has neither next hop nor payload")
+  }
+  gossiper.pruneOnionState()
+  gossiper.OnionRelays[layer.NextCircuit] = back
+  gossiper.ForwardOnion(&OnionPacket{
+    Destination: layer.Next,
+    HopLimit: 10,
+    Circuit: layer.NextCircuit,
+    Data: layer.Inner,
+  })
+  return nil
+}
+
+// Peels the layers added by each hop of our circuit, then the destination's.
+func (gossiper *Gossiper) receiveOnionReply(circuit *onionCircuit, data []byte) error {
+  var err error
+  for _, key := range circuit.keys {
+    if data, err = openSymmetric(key, data); err != nil {
+      return err
+    }
+  }
+  var payload OnionPayload
+  if err := protobuf.Decode(data, &payload); err != nil {
+    return err
+  }
+  if payload.Message != nil && payload.Message.Origin != circuit.destination ||
+    payload.Ack != nil && payload.Ack.Origin != circuit.destination {
+    return errors.New("reply doesn't come from the circuit's destination")
+  }
+  circuit.expires = time.Now().Add(ONION_CIRCUIT_TTL)
+  if payload.Ack != nil {
+    gossiper.ProcessPrivateAck(payload.Ack)
+  }
+  if payload.Message != nil && gossiper.markPrivateReceived(payload.Message) {
+    payload.Message.Log()
+    gossiper.RecordPrivate(payload.Message)
+    // Acknowledged forward, the destination has no circuit to us
+    if err := gossiper.SendOnion(circuit.destination, &OnionPayload{Ack: &PrivateAck{
+      Origin: gossiper.Name,
+      Destination: payload.Message.Origin,
+      ID: payload.Message.ID,
+    }}); err != nil {
+      fmt.Println("ONION failed:", err)
+    }
+  }
+  return nil
+}
+
+// Handles what a circuit delivered to us, answering over the same circuit.
+// Only payloads authenticated by their origin's onion key are accepted.
+func (gossiper *Gossiper) receiveOnionPayload(layer *OnionLayer, back *onionReturn) error {
+  payload := layer.Payload
+  origin := ""
+  if payload.Message != nil {
+    origin = payload.Message.Origin
+  } else if payload.Ack != nil {
+    origin = payload.Ack.Origin
+  }
+  if payload.Message != nil && payload.Ack != nil && payload.Ack.Origin != origin {
+    return errors.New("payload has two origins")
+  }
+  auth, err := gossiper.onionAuthKey(origin)
+  if err != nil {
+    return err
+  }
+  if !hmac.Equal(layer.Auth, mac(auth, onionAuthTranscript(back.circuit, layer))) {
+    return fmt.Errorf("payload isn't authenticated by %s", origin)
+  }
+  if payload.Message != nil {
+    pm := payload.Message
+    if pm.Destination != gossiper.Name || checkName("Onion", "Origin", pm.Origin) != nil {
+      return errors.New("message isn't for us")
+    }
+    gossiper.OnionReplies[pm.Origin] = back
+    if gossiper.markPrivateReceived(pm) {
+      pm.Log()
+      gossiper.RecordPrivate(pm)
+    }
+    gossiper.ReplyOnion(pm.Origin, &OnionPayload{Ack: &PrivateAck{
+      Origin: gossiper.Name,
+      Destination: pm.Origin,
+      ID: pm.ID,
+    }})
+  }
+  if payload.Ack != nil && payload.Ack.Destination == gossiper.Name {
+    gossiper.ProcessPrivateAck(payload.Ack)
+  }
+  return nil
+}
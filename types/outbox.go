@@ -0,0 +1,163 @@
+package types
+
+import (
+  "fmt"
+  "time"
+  "errors"
+  "path/filepath"
+  "crypto/ecdh"
+  "github.com/dedis/protobuf"
+)
+
+var OUTBOX_EXPIRY = 10 * time.Minute
+var MAX_OUTBOX_SIZE = 64 // Per destination
+var MAIL_KEY_FILE = "mail.key"
+
+type OutboxEntry struct {
+  Packet *GossipPacket
+  Expires time.Time
+}
+
+// Keeps a packet for destination until UpdateRoute learns how to reach it.
+func (gossiper* Gossiper) QueuePacket(destination string, packet *GossipPacket, expires time.Time) {
+  var kept []*OutboxEntry
+  for _, entry := range gossiper.Outbox[destination] {
+    if time.Now().After(entry.Expires) {
+      continue
+    }
+    // Retransmissions reuse the same message, don't queue it twice
+    if entry.Packet.Private != nil && entry.Packet.Private == packet.Private ||
+      entry.Packet.DataRequest != nil && entry.Packet.DataRequest == packet.DataRequest {
+      return
+    }
+    kept = append(kept, entry)
+  }
+  if len(kept) >= MAX_OUTBOX_SIZE {
+    fmt.Println("OUTBOX FULL for", destination)
+    return
+  }
+  gossiper.Outbox[destination] = append(kept, &OutboxEntry{packet, expires})
+  fmt.Println("QUEUED packet for", destination)
+}
+
+func (gossiper* Gossiper) FlushOutbox(destination string) {
+  entries := gossiper.Outbox[destination]
+  if len(entries) == 0 || gossiper.Router[destination] == nil {
+    return
+  }
+  delete(gossiper.Outbox, destination)
+  for _, entry := range entries {
+    if time.Now().Before(entry.Expires) {
+      gossiper.SendPacket(gossiper.Router[destination], entry.Packet)
+    }
+  }
+  fmt.Println("FLUSHED outbox of", destination)
+}
+
+// Reads the X25519 key mail for us is encrypted to, creating it if there is
+// none yet. Mail already left for us needs it to be kept across restarts.
+func LoadOrCreateMailKey(dir string) (*ecdh.PrivateKey, error) {
+  return loadOrCreateX25519Key(filepath.Join(dir, MAIL_KEY_FILE))
+}
+
+// Our public mail key, advertised in our route rumors.
+func (gossiper* Gossiper) MailPublicKey() []byte {
+  if gossiper.MailKey == nil {
+    return nil
+  }
+  return gossiper.MailKey.PublicKey().Bytes()
+}
+
+// Leaves a private message with every mailbox we can reach, encrypted so
+// only its destination can read it. Returns false if there was no mailbox to
+// leave it with, or no mail key is known for the destination.
+func (gossiper* Gossiper) DepositMail(pm *PrivateMessage) bool {
+  key := gossiper.MailKeys[pm.Destination]
+  if key == nil {
+    return false
+  }
+  plaintext, err := protobuf.Encode(pm)
+  if err != nil {
+    return false
+  }
+  sealed, err := sealTo(key, "peerster mail", plaintext)
+  if err != nil {
+    fmt.Println("Can't seal mail for", pm.Destination + ":", err)
+    return false
+  }
+  deposited := 0
+  for mailbox, isMailbox := range gossiper.Mailboxes {
+    if !isMailbox || mailbox == pm.Destination || gossiper.Router[mailbox] == nil {
+      continue
+    }
+    gossiper.ForwardMail(&Mail{
+      Destination: mailbox,
+      Recipient: pm.Destination,
+      HopLimit: 10,
+      Sealed: sealed,
+      Expires: time.Now().Add(OUTBOX_EXPIRY).Unix(),
+    })
+    deposited++
+  }
+  if deposited > 0 {
+    fmt.Println("MAIL for", pm.Destination, "left with", deposited, "mailboxes")
+  }
+  return deposited > 0
+}
+
+func (gossiper* Gossiper) ForwardMail(mail *Mail) {
+  if mail.HopLimit == 0 || gossiper.Router[mail.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(gossiper.Router[mail.Destination], &GossipPacket{Mail: mail})
+}
+
+// Reads mail left for us, or holds mail for another node until it is reachable.
+func (gossiper* Gossiper) ReceiveMail(mail *Mail) {
+  if mail.Recipient == gossiper.Name {
+    gossiper.openMail(mail)
+    return
+  }
+  if !gossiper.IsMailbox {
+    return
+  }
+  expires := time.Unix(mail.Expires, 0)
+  if maxExpires := time.Now().Add(OUTBOX_EXPIRY); expires.After(maxExpires) {
+    expires = maxExpires
+  }
+  fmt.Println("MAIL for", mail.Recipient)
+  held := &Mail{
+    Destination: mail.Recipient,
+    Recipient: mail.Recipient,
+    HopLimit: 10,
+    Sealed: mail.Sealed,
+    Expires: expires.Unix(),
+  }
+  if gossiper.Router[mail.Recipient] != nil {
+    gossiper.ForwardMail(held)
+  } else {
+    gossiper.QueuePacket(mail.Recipient, &GossipPacket{Mail: held}, expires)
+  }
+}
+
+func (gossiper* Gossiper) openMail(mail *Mail) {
+  if gossiper.MailKey == nil {
+    return
+  }
+  plaintext, err := openSealed(gossiper.MailKey, "peerster mail", mail.Sealed)
+  var pm PrivateMessage
+  if err == nil {
+    err = protobuf.Decode(plaintext, &pm)
+  }
+  if err == nil && (pm.Destination != gossiper.Name || validatePrivate(&pm) != nil) {
+    err = errors.New("not a private message for us")
+  }
+  if err != nil {
+    fmt.Println("UNREADABLE mail:", err)
+    return
+  }
+  if gossiper.ReceivePrivate(&pm) {
+    pm.Log()
+    gossiper.RecordPrivate(&pm)
+  }
+}
@@ -12,12 +12,18 @@ type SimpleMessage struct {
   OriginalName string
   RelayPeerAddr string
   Contents string
+  ID uint32 // Unique per origin, 0 from peers that don't number their messages
+  HopLimit uint32
 }
 
 type RumorMessage struct {
   Origin string
   ID uint32
   Text string
+  Channel string // Empty for the global stream
+  OnionKey []byte // X25519 key of the origin, on its route rumors
+  MailKey []byte // X25519 key mail for the origin is encrypted to, on its route rumors
+  Mailbox bool // Whether the origin holds mail for others, on its route rumors
 }
 
 type PrivateMessage struct {
@@ -28,6 +34,24 @@ type PrivateMessage struct {
   HopLimit uint32
 }
 
+// Sent back by the destination of a PrivateMessage once it received it
+type PrivateAck struct {
+  Origin string
+  Destination string
+  HopLimit uint32
+  ID uint32
+}
+
+// A private message left with mailboxes while its recipient is unreachable.
+// Only the recipient can read it.
+type Mail struct {
+  Destination string // Mailbox it is left with, then the recipient
+  Recipient string
+  HopLimit uint32
+  Sealed []byte // PrivateMessage encrypted to the mail key of the recipient
+  Expires int64 // Unix time
+}
+
 type StatusPacket struct {
   Want []PeerStatus
 }
@@ -37,11 +61,17 @@ type PeerStatus struct {
   NextID uint32
 }
 
+type GapRequest struct {
+  Origin string
+  IDs []uint32
+}
+
 type DataRequest struct {
   Origin string
   Destination string
   HopLimit uint32
   HashValue []byte
+  Nonce uint32 // Echoed by the reply, to match it with this request
 }
 
 type DataReply struct {
@@ -50,13 +80,35 @@ type DataReply struct {
   HopLimit uint32
   HashValue []byte
   Data []byte
+  Nonce uint32 // Of the request this answers
+}
+
+// Asks which chunks of the file with that metahash the destination holds
+type ChunkMapRequest struct {
+  Origin string
+  Destination string
+  HopLimit uint32
+  MetaHash []byte
+}
+
+type ChunkMapReply struct {
+  Origin string
+  Destination string
+  HopLimit uint32
+  MetaHash []byte
+  NumChunks uint32
+  Bitmap []byte // Bit i is set if chunk i of the metafile is held
 }
 
 type Message struct {
   Text string
   Destination string
+  Onion bool // Send the private message over a circuit
   File string
   Request string
+  Channel string
+  Join string
+  Leave string
 }
 
 type GossipPacket struct {
@@ -66,6 +118,19 @@ type GossipPacket struct {
   Private *PrivateMessage
   DataRequest *DataRequest
   DataReply   *DataReply
+  Gap *GapRequest
+  PrivateAck *PrivateAck
+  Mail *Mail
+  TxPublish *TxPublish
+  BlockPublish *BlockPublish
+  Paxos *PaxosMessage
+  DHT *DHTMessage
+  ChunkMapRequest *ChunkMapRequest
+  ChunkMapReply *ChunkMapReply
+  JoinChallenge *JoinChallenge
+  JoinRequest *JoinRequest
+  Onion *OnionPacket
+  BlockRequest *BlockRequest
 }
 
 func (packet* StatusPacket) ToMap() map[string]uint32 {
@@ -123,6 +188,17 @@ func (packet *StatusPacket) Log(relayAddress string) {
   fmt.Println("STATUS from", relayAddress, str)
 }
 
+func (packet *GapRequest) Log(relayAddress string) {
+  str := ""
+  for i, id := range packet.IDs {
+    if i > 0 {
+      str += ","
+    }
+    str += strconv.FormatUint(uint64(id), 10)
+  }
+  fmt.Println("GAP REQUEST from", relayAddress, "origin", packet.Origin, "IDs", str)
+}
+
 func (packet *PrivateMessage) Log() {
   fmt.Println("PRIVATE origin", packet.Origin, "hop-limit", packet.HopLimit, "contents", packet.Text)
 }
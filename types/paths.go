@@ -0,0 +1,125 @@
+package types
+
+import (
+  "os"
+  "fmt"
+  "path"
+  "strings"
+  "path/filepath"
+)
+
+var DOWNLOAD_DIR = "_Downloads" // Default of Gossiper.DownloadDir
+var MAX_PATH_LENGTH = 4096
+var MAX_PATH_PART_LENGTH = 255 // Of each path component
+
+// Accepts relative, slash separated paths that stay below where they start.
+// Names come from UI clients and peers, so anything unusual is refused.
+func SafePath(name string) error {
+  if name == "" || len(name) > MAX_PATH_LENGTH || path.IsAbs(name) || path.Clean(name) != name ||
+    name == ".." || strings.HasPrefix(name, "../") || !filepath.IsLocal(filepath.FromSlash(name)) {
+    return fmt.Errorf("unsafe path %q", name)
+  }
+  for _, c := range name {
+    if c < 0x20 || c == 0x7f || c == '\\' {
+      return fmt.Errorf("unsafe character %q in path %q", c, name)
+    }
+  }
+  for _, part := range strings.Split(name, "/") {
+    if len(part) > MAX_PATH_PART_LENGTH {
+      return fmt.Errorf("%q is longer than %d bytes", part, MAX_PATH_PART_LENGTH)
+    }
+  }
+  return nil
+}
+
+// Stats name below root, refusing symbolic links on the way so nothing
+// outside of root can be reached.
+func StatInside(root, name string) (os.FileInfo, error) {
+  if err := SafePath(name); err != nil {
+    return nil, err
+  }
+  current := root
+  var info os.FileInfo
+  for _, part := range strings.Split(name, "/") {
+    current = filepath.Join(current, part)
+    var err error
+    if info, err = os.Lstat(current); err != nil {
+      return nil, err
+    }
+    if info.Mode() & os.ModeSymlink != 0 {
+      return nil, fmt.Errorf("%s is a symbolic link", current)
+    }
+  }
+  return info, nil
+}
+
+// Creates the directory dir below root, and its parents, refusing to go
+// through symbolic links or files.
+func mkdirInside(root, dir string) error {
+  if err := os.MkdirAll(root, 0755); err != nil || dir == "." {
+    return err
+  }
+  if err := SafePath(dir); err != nil {
+    return err
+  }
+  current := root
+  for _, part := range strings.Split(dir, "/") {
+    current = filepath.Join(current, part)
+    info, err := os.Lstat(current)
+    if os.IsNotExist(err) {
+      err = os.Mkdir(current, 0755)
+    } else if err == nil && !info.IsDir() {
+      err = fmt.Errorf("%s is not a directory", current)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Returns name, or the first of "name (1).ext", "name (2).ext"... that
+// nothing in the download directory dir has.
+func freeDownloadName(dir, name string) string {
+  extension := path.Ext(name)
+  base := strings.TrimSuffix(name, extension)
+  if base == "" || strings.HasSuffix(base, "/") {
+    base, extension = name, ""
+  }
+  candidate := name
+  for i := 1; ; i++ {
+    if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(candidate))); os.IsNotExist(err) {
+      return candidate
+    }
+    candidate = fmt.Sprintf("%s (%d)%s", base, i, extension)
+  }
+}
+
+// Writes the file to the download directory dir, creating the directories it
+// is in. Returns the name it was written as, renamed if name was taken.
+func (file *File) writeDownload(dir, name string, mode uint32) (string, error) {
+  if err := SafePath(name); err != nil {
+    return "", err
+  }
+  if err := mkdirInside(dir, path.Dir(name)); err != nil {
+    return "", err
+  }
+  if mode == 0 {
+    mode = 0644
+  }
+  name = freeDownloadName(dir, name)
+  return name, writeFileAtomic(filepath.Join(dir, filepath.FromSlash(name)), file.Data(), os.FileMode(mode))
+}
+
+// Reserves a directory for a downloaded tree in the download directory dir,
+// renamed if name was taken.
+func makeDownloadDir(dir, name string) (string, error) {
+  if err := SafePath(name); err != nil {
+    return "", err
+  }
+  if err := mkdirInside(dir, path.Dir(name)); err != nil {
+    return "", err
+  }
+  name = freeDownloadName(dir, name)
+  return name, os.Mkdir(filepath.Join(dir, filepath.FromSlash(name)), 0755)
+}
@@ -0,0 +1,219 @@
+package types
+
+import (
+  "fmt"
+  "time"
+  "strconv"
+  "encoding/json"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var PRIVATE_RETRY_TIMEOUT = time.Second // Doubled after each retry
+var PRIVATE_MAX_RETRIES = 5
+var PRIVATE_RECEIVED_WINDOW = uint32(1024) // IDs remembered above the highest one received in sequence
+
+const (
+  DELIVERY_PENDING = "pending"
+  DELIVERY_DELIVERED = "delivered"
+  DELIVERY_FAILED = "failed"
+)
+
+type OutgoingPrivate struct {
+  Message *PrivateMessage
+  Status string
+  Retries int
+  Timeout chan bool
+  Onion bool // Sent over circuits rather than along routes
+  Held time.Time // Until when a copy waiting in an outbox or mailbox may still be delivered
+}
+
+// The private message IDs received from an origin: all of them up to Highest,
+// and those set in Above.
+type ReceivedIDs struct {
+  Highest uint32
+  Above map[uint32]bool
+}
+
+// Records id, returns false if it was already received.
+func (received *ReceivedIDs) mark(id uint32) bool {
+  if id <= received.Highest || received.Above[id] {
+    return false
+  }
+  if received.Above == nil {
+    received.Above = make(map[uint32]bool)
+  }
+  received.Above[id] = true
+  // IDs too far behind are given up on, as if they were received
+  if id - received.Highest > PRIVATE_RECEIVED_WINDOW {
+    received.Highest = id - PRIVATE_RECEIVED_WINDOW
+    for old := range received.Above {
+      if old <= received.Highest {
+        delete(received.Above, old)
+      }
+    }
+  }
+  for received.Above[received.Highest + 1] {
+    delete(received.Above, received.Highest + 1)
+    received.Highest++
+  }
+  return true
+}
+
+func outgoingKey(peer string, id uint32) string {
+  return peer + "/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// Sends a private message with the next sequence number of the conversation,
+// retransmitting it until the destination acknowledges it.
+func (gossiper* Gossiper) SendPrivate(text, destination string, onion bool) *PrivateMessage {
+  gossiper.PrivateSeq[destination]++
+  pm := &PrivateMessage{
+    Origin: gossiper.Name,
+    ID: gossiper.PrivateSeq[destination],
+    Text: text,
+    Destination: destination,
+    HopLimit: 10,
+  }
+  out := &OutgoingPrivate{
+    Message: pm,
+    Status: DELIVERY_PENDING,
+    Onion: onion,
+  }
+  gossiper.OutgoingPrivates[outgoingKey(destination, pm.ID)] = out
+  gossiper.RecordPrivate(pm)
+  // Mailboxes would learn who talks to whom
+  if !out.Onion && gossiper.Router[destination] == nil && gossiper.DepositMail(pm) {
+    out.Held = time.Now().Add(OUTBOX_EXPIRY)
+  }
+  gossiper.transmitPrivate(out)
+  return pm
+}
+
+func (gossiper* Gossiper) transmitPrivate(out *OutgoingPrivate) {
+  if !out.Onion {
+    if gossiper.Router[out.Message.Destination] == nil {
+      // Waits in our outbox
+      out.Held = time.Now().Add(OUTBOX_EXPIRY)
+    }
+    gossiper.ForwardPrivate(out.Message)
+  } else if payload := (&OnionPayload{Message: out.Message}); !gossiper.ReplyOnion(out.Message.Destination, payload) {
+    if err := gossiper.SendOnion(out.Message.Destination, payload); err != nil {
+      fmt.Println("ONION failed:", err)
+    }
+  }
+  var timeout chan bool
+  timeout = utils.SetTimeout(func() {
+    gossiper.Post(func() {
+      if out.Timeout != timeout || out.Status != DELIVERY_PENDING {
+        return
+      }
+      out.Retries++
+      if out.Retries > PRIVATE_MAX_RETRIES {
+        gossiper.expirePrivate(out)
+        return
+      }
+      fmt.Println("PRIVATE RETRY to", out.Message.Destination, "ID", out.Message.ID)
+      gossiper.transmitPrivate(out)
+    })
+  }, PRIVATE_RETRY_TIMEOUT << uint(out.Retries))
+  out.Timeout = timeout
+}
+
+// Gives up retransmitting, but only reports the message as failed once no
+// outbox or mailbox can deliver it anymore.
+func (gossiper* Gossiper) expirePrivate(out *OutgoingPrivate) {
+  if wait := time.Until(out.Held); wait > 0 {
+    fmt.Println("PRIVATE HELD for", out.Message.Destination, "ID", out.Message.ID, "until", out.Held.Format(time.RFC3339))
+    var timeout chan bool
+    timeout = utils.SetTimeout(func() {
+      gossiper.Post(func() {
+        if out.Timeout == timeout && out.Status == DELIVERY_PENDING {
+          gossiper.expirePrivate(out)
+        }
+      })
+    }, wait)
+    out.Timeout = timeout
+    return
+  }
+  out.Timeout = nil
+  out.Status = DELIVERY_FAILED
+  fmt.Println("PRIVATE FAILED to", out.Message.Destination, "ID", out.Message.ID)
+}
+
+// Acknowledges a private message addressed to us, and returns false if we
+// already received it.
+func (gossiper* Gossiper) ReceivePrivate(pm *PrivateMessage) bool {
+  // Messages without sequence number can't be acknowledged nor deduplicated
+  if pm.ID == 0 {
+    return true
+  }
+  gossiper.ForwardPrivateAck(&PrivateAck{
+    Origin: gossiper.Name,
+    Destination: pm.Origin,
+    HopLimit: 10,
+    ID: pm.ID,
+  })
+  return gossiper.markPrivateReceived(pm)
+}
+
+// Records a private message as received, returns false if it already was.
+func (gossiper* Gossiper) markPrivateReceived(pm *PrivateMessage) bool {
+  if pm.ID == 0 {
+    return true
+  }
+  if gossiper.ReceivedPrivates[pm.Origin] == nil {
+    gossiper.ReceivedPrivates[pm.Origin] = &ReceivedIDs{}
+  }
+  return gossiper.ReceivedPrivates[pm.Origin].mark(pm.ID)
+}
+
+func (gossiper* Gossiper) ProcessPrivateAck(ack *PrivateAck) {
+  out := gossiper.OutgoingPrivates[outgoingKey(ack.Origin, ack.ID)]
+  if out == nil || out.Status == DELIVERY_DELIVERED {
+    return
+  }
+  if out.Timeout != nil {
+    close(out.Timeout)
+    out.Timeout = nil
+  }
+  out.Status = DELIVERY_DELIVERED
+  fmt.Println("PRIVATE DELIVERED to", ack.Origin, "ID", ack.ID)
+}
+
+func (gossiper* Gossiper) ForwardPrivateAck(ack *PrivateAck) {
+  if ack.HopLimit == 0 || gossiper.Router[ack.Destination] == nil {
+    return
+  }
+  gossiper.SendPacket(
+    gossiper.Router[ack.Destination],
+    &GossipPacket{PrivateAck: ack})
+}
+
+// Returns the delivery status of a private message we sent, or "" otherwise.
+func (gossiper* Gossiper) DeliveryStatus(pm *PrivateMessage) string {
+  if pm.Origin != gossiper.Name {
+    return ""
+  }
+  out := gossiper.OutgoingPrivates[outgoingKey(pm.Destination, pm.ID)]
+  if out == nil {
+    return ""
+  }
+  return out.Status
+}
+
+// Like GossipPacket.ToJSON, with the delivery status of our own private messages.
+func (gossiper* Gossiper) MessageToJSON(packet *GossipPacket) string {
+  if packet.Private == nil {
+    return packet.ToJSON()
+  }
+  status := gossiper.DeliveryStatus(packet.Private)
+  if status == "" {
+    return packet.ToJSON()
+  }
+  bytes, err := json.Marshal(struct {
+    *PrivateMessage
+    Status string
+  }{packet.Private, status})
+  utils.CheckError(err)
+  return string(bytes)
+}
@@ -0,0 +1,32 @@
+package types
+
+import "testing"
+
+// Received IDs are deduplicated, and those far behind the newest are dropped.
+func TestReceivedIDsWindow(t *testing.T) {
+  received := &ReceivedIDs{}
+  for _, id := range []uint32{2, 1, 3} {
+    if !received.mark(id) {
+      t.Error("new ID", id, "seen as received")
+    }
+  }
+  if received.mark(2) {
+    t.Error("ID 2 accepted twice")
+  }
+  if received.Highest != 3 || len(received.Above) != 0 {
+    t.Error("in-sequence IDs kept in the window:", received.Highest, received.Above)
+  }
+  last := 5 + 3 * PRIVATE_RECEIVED_WINDOW
+  for id := uint32(5); id <= last; id += 2 {
+    received.mark(id)
+  }
+  if uint32(len(received.Above)) > PRIVATE_RECEIVED_WINDOW {
+    t.Error("window holds", len(received.Above), "IDs")
+  }
+  if received.mark(4) {
+    t.Error("ID behind the window accepted")
+  }
+  if !received.mark(last - 1) {
+    t.Error("missing ID inside the window refused")
+  }
+}
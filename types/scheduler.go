@@ -0,0 +1,267 @@
+package types
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+)
+
+// Outgoing packets are sent by priority class, most urgent first
+const (
+  PRIORITY_CONTROL = iota // Status, acks, gap requests
+  PRIORITY_ROUTING // Route rumors, DHT, naming
+  PRIORITY_CHAT // Rumors, private and simple messages
+  PRIORITY_BULK // File transfers
+  NUM_PRIORITIES
+)
+
+var MAX_QUEUED_PACKETS = 1024 // Per priority class
+var MAX_PACKET_SIZE = 16384
+var REQUEST_LIMITS_SWEEP = time.Minute // How often buckets of idle peers are dropped
+
+// Allows rate units per second on average, with bursts of up to burst units.
+// A rate of 0 means unlimited.
+type TokenBucket struct {
+  rate float64
+  burst float64
+  tokens float64
+  last time.Time
+}
+
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+  return &TokenBucket{rate, burst, burst, time.Now()}
+}
+
+func (bucket *TokenBucket) refill() {
+  now := time.Now()
+  bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+  if bucket.tokens > bucket.burst {
+    bucket.tokens = bucket.burst
+  }
+  bucket.last = now
+}
+
+// Returns how long to wait before n units are available.
+func (bucket *TokenBucket) Delay(n float64) time.Duration {
+  if bucket.rate <= 0 {
+    return 0
+  }
+  bucket.refill()
+  if bucket.tokens >= n {
+    return 0
+  }
+  return time.Duration((n - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+func (bucket *TokenBucket) Take(n float64) {
+  if bucket.rate > 0 {
+    bucket.tokens -= n
+  }
+}
+
+// Whether the bucket refilled completely since it was last used.
+func (bucket *TokenBucket) Idle() bool {
+  bucket.refill()
+  return bucket.tokens >= bucket.burst
+}
+
+// Takes n units if available right away.
+func (bucket *TokenBucket) Allow(n float64) bool {
+  if bucket.Delay(n) > 0 {
+    return false
+  }
+  bucket.Take(n)
+  return true
+}
+
+type outgoingPacket struct {
+  destination *net.UDPAddr
+  data []byte
+}
+
+// Shapes outgoing traffic under a global and a per-peer bandwidth limit.
+// Classes are served by strict priority, and peers round-robin within a class
+// so one large transfer doesn't starve the others.
+type SendScheduler struct {
+  lock sync.Mutex
+  conn *net.UDPConn
+  wake chan bool
+  queues [NUM_PRIORITIES]map[string][]*outgoingPacket // Map[Peer -> Packets]
+  order [NUM_PRIORITIES][]string // Round-robin order of peers with queued packets
+  queued [NUM_PRIORITIES]int
+  global *TokenBucket
+  peers map[string]*TokenBucket
+  peerRate float64
+  Dropped uint64
+}
+
+// Rates are in bytes per second, 0 for unlimited.
+func NewSendScheduler(conn *net.UDPConn, globalRate, peerRate int) *SendScheduler {
+  scheduler := &SendScheduler{
+    conn: conn,
+    wake: make(chan bool, 1),
+    global: NewTokenBucket(float64(globalRate), burstFor(globalRate)),
+    peers: make(map[string]*TokenBucket),
+    peerRate: float64(peerRate),
+  }
+  for i := range scheduler.queues {
+    scheduler.queues[i] = make(map[string][]*outgoingPacket)
+  }
+  go scheduler.run()
+  return scheduler
+}
+
+// A second worth of traffic, but always room for the largest packet.
+func burstFor(rate int) float64 {
+  if rate < MAX_PACKET_SIZE {
+    return float64(MAX_PACKET_SIZE)
+  }
+  return float64(rate)
+}
+
+func (scheduler *SendScheduler) Enqueue(destination *net.UDPAddr, data []byte, priority int) {
+  scheduler.lock.Lock()
+  if scheduler.queued[priority] >= MAX_QUEUED_PACKETS {
+    scheduler.Dropped++
+    scheduler.lock.Unlock()
+    fmt.Println("SEND QUEUE FULL, dropping packet to", destination.String())
+    return
+  }
+  peer := destination.String()
+  if len(scheduler.queues[priority][peer]) == 0 {
+    scheduler.order[priority] = append(scheduler.order[priority], peer)
+  }
+  scheduler.queues[priority][peer] = append(scheduler.queues[priority][peer], &outgoingPacket{destination, data})
+  scheduler.queued[priority]++
+  scheduler.lock.Unlock()
+
+  select {
+  case scheduler.wake <- true:
+  default:
+  }
+}
+
+func (scheduler *SendScheduler) peerBucket(peer string) *TokenBucket {
+  bucket := scheduler.peers[peer]
+  if bucket == nil {
+    bucket = NewTokenBucket(scheduler.peerRate, burstFor(int(scheduler.peerRate)))
+    scheduler.peers[peer] = bucket
+  }
+  return bucket
+}
+
+// Pops the next packet allowed by the limits, or returns how long to wait for one.
+func (scheduler *SendScheduler) next() (*outgoingPacket, time.Duration) {
+  scheduler.lock.Lock()
+  defer scheduler.lock.Unlock()
+
+  wait := time.Duration(-1) // Nothing queued
+  for priority := range scheduler.queues {
+    order := scheduler.order[priority]
+    for i, peer := range order {
+      packet := scheduler.queues[priority][peer][0]
+      size := float64(len(packet.data))
+      delay := scheduler.global.Delay(size)
+      if peerDelay := scheduler.peerBucket(peer).Delay(size); peerDelay > delay {
+        delay = peerDelay
+      }
+      if delay > 0 {
+        if wait < 0 || delay < wait {
+          wait = delay
+        }
+        continue
+      }
+      scheduler.global.Take(size)
+      scheduler.peerBucket(peer).Take(size)
+
+      remaining := scheduler.queues[priority][peer][1:]
+      // Move the peer to the back of the round
+      order = append(order[:i:i], order[i + 1:]...)
+      if len(remaining) > 0 {
+        scheduler.queues[priority][peer] = remaining
+        order = append(order, peer)
+      } else {
+        delete(scheduler.queues[priority], peer)
+      }
+      scheduler.order[priority] = order
+      scheduler.queued[priority]--
+      return packet, 0
+    }
+  }
+  return nil, wait
+}
+
+func (scheduler *SendScheduler) run() {
+  for {
+    packet, wait := scheduler.next()
+    if packet != nil {
+      scheduler.conn.WriteToUDP(packet.data, packet.destination)
+      continue
+    }
+    if wait < 0 {
+      <-scheduler.wake
+      continue
+    }
+    select {
+    case <-scheduler.wake:
+    case <-time.After(wait):
+    }
+  }
+}
+
+func PacketPriority(packet *GossipPacket) int {
+  switch {
+  case packet.Status != nil || packet.Gap != nil || packet.PrivateAck != nil ||
+    packet.JoinChallenge != nil || packet.JoinRequest != nil:
+    return PRIORITY_CONTROL
+  case packet.Rumor != nil && packet.Rumor.Text == "":
+    return PRIORITY_ROUTING
+  case packet.DHT != nil || packet.Paxos != nil || packet.TxPublish != nil || packet.BlockPublish != nil:
+    return PRIORITY_ROUTING
+  case packet.Rumor != nil || packet.Private != nil || packet.Simple != nil || packet.Mail != nil || packet.Onion != nil:
+    return PRIORITY_CHAT
+  }
+  return PRIORITY_BULK
+}
+
+// Whether a packet asks us for work, and so counts against the inbound
+// request limit. Requests we only forward don't.
+func (gossiper *Gossiper) IsRequest(packet *GossipPacket) bool {
+  switch {
+  case packet.DataRequest != nil:
+    return packet.DataRequest.Destination == gossiper.Name
+  case packet.ChunkMapRequest != nil:
+    return packet.ChunkMapRequest.Destination == gossiper.Name
+  case packet.DHT != nil:
+    return packet.DHT.Type == DHT_FIND && packet.DHT.Destination == gossiper.Name
+  }
+  return packet.Gap != nil || packet.BlockRequest != nil
+}
+
+// Limits how many requests per second each peer can make us answer.
+func (gossiper *Gossiper) AllowRequest(sender *net.UDPAddr) bool {
+  if gossiper.RequestRate <= 0 {
+    return true
+  }
+  if time.Since(gossiper.requestLimitsSwept) > REQUEST_LIMITS_SWEEP {
+    gossiper.evictIdleRequestLimits()
+  }
+  bucket := gossiper.RequestLimits[sender.String()]
+  if bucket == nil {
+    bucket = NewTokenBucket(gossiper.RequestRate, gossiper.RequestRate)
+    gossiper.RequestLimits[sender.String()] = bucket
+  }
+  return bucket.Allow(1)
+}
+
+// Forgets the buckets of peers that stopped making requests, a full bucket
+// being the same as a new one.
+func (gossiper *Gossiper) evictIdleRequestLimits() {
+  for peer, bucket := range gossiper.RequestLimits {
+    if bucket.Idle() {
+      delete(gossiper.RequestLimits, peer)
+    }
+  }
+  gossiper.requestLimitsSwept = time.Now()
+}
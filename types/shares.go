@@ -0,0 +1,391 @@
+package types
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+  "bytes"
+  "errors"
+  "strings"
+  "io/fs"
+  "path/filepath"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+)
+
+var SHARED_SCAN_PERIOD = 5 * time.Second // Default of ShareWatcher.ScanPeriod
+var HASH_CACHE_FILE = "hashes.json"
+
+// How a shared file was split and hashed. Kept across restarts, so files
+// whose size and modification time didn't change aren't hashed again.
+type FileIndex struct {
+  Name string // Relative to its shared directory, slash separated
+  Size int64
+  ModTime int64 // Unix nanoseconds
+  Mode uint32 // Permission bits
+  Directory bool // Indexes the manifest of the files under Name
+  Chunking string
+  MetaHash []byte
+  MetaFile []byte
+  ChunkSizes []int
+}
+
+// A shared file that appeared, changed or disappeared.
+type ShareChange struct {
+  Name string
+  Old *FileIndex // nil if the file is new
+  New *FileIndex // nil if the file was deleted
+  Chunks map[string][]byte // Map[Hash -> Chunk] of New
+}
+
+// Finds the files of shared directories, and their subdirectories, that
+// changed since the last scan.
+type ShareWatcher struct {
+  lock sync.Mutex
+  Dirs []string // Earlier ones win when several have a file of the same name
+  ChunkSizes *ChunkSizes // Content-defined chunking if set, fixed size chunks otherwise
+  ScanPeriod time.Duration // Between scans, 0 to only share on request
+  cacheFile string
+  cache map[string]*FileIndex // Map[Path -> Last indexing], possibly by a previous run
+  shared map[string]string // Map[Name -> Path] of the files given to the gossiper
+  directories map[string]string // Map[Name -> Path] of the directories shared as a manifest
+}
+
+// Loads the hash cache of stateDir, if any. Directories shared as a manifest
+// by a previous run are shared again.
+func NewShareWatcher(dirs []string, sizes *ChunkSizes, stateDir string) *ShareWatcher {
+  watcher := &ShareWatcher{
+    Dirs: dirs,
+    ChunkSizes: sizes,
+    ScanPeriod: SHARED_SCAN_PERIOD,
+    cacheFile: filepath.Join(stateDir, HASH_CACHE_FILE),
+    cache: make(map[string]*FileIndex),
+    shared: make(map[string]string),
+    directories: make(map[string]string),
+  }
+  if data, err := os.ReadFile(watcher.cacheFile); err == nil {
+    if err := json.Unmarshal(data, &watcher.cache); err != nil {
+      fmt.Println("IGNORING corrupted hash cache", watcher.cacheFile)
+      watcher.cache = make(map[string]*FileIndex)
+    }
+  }
+  for path, index := range watcher.cache {
+    if index.Directory {
+      watcher.directories[index.Name] = path
+    }
+  }
+  return watcher
+}
+
+// Which chunks an indexing has, so changing chunking settings rehashes.
+func (watcher *ShareWatcher) chunkingMode() string {
+  if sizes := watcher.ChunkSizes; sizes != nil {
+    return fmt.Sprintf("cdc/%d/%d/%d", sizes.Min, sizes.Avg, sizes.Max)
+  }
+  return fmt.Sprintf("fixed/%d", FILE_CHUNK_SIZE)
+}
+
+// Calls visit with the regular files under start, named relative to root.
+// Hidden and temporary files are skipped, and so are unreadable entries.
+func walkShared(root, start string, visit func(name, path string)) {
+  filepath.WalkDir(start, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil || !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") ||
+      strings.HasSuffix(entry.Name(), ".tmp") {
+      return nil
+    }
+    // Names we couldn't download are not shared either
+    if relative, err := filepath.Rel(root, path); err == nil && SafePath(filepath.ToSlash(relative)) == nil {
+      visit(filepath.ToSlash(relative), path)
+    }
+    return nil
+  })
+}
+
+func (watcher *ShareWatcher) Scan() []*ShareChange {
+  watcher.lock.Lock()
+  defer watcher.lock.Unlock()
+  var changes []*ShareChange
+  seen := make(map[string]bool)
+  for _, dir := range watcher.Dirs {
+    walkShared(dir, dir, func(name, path string) {
+      if seen[name] {
+        return
+      }
+      seen[name] = true
+      change, err := watcher.index(name, path)
+      if err != nil {
+        fmt.Println("Can't index", path + ":", err)
+      } else if change != nil {
+        changes = append(changes, change)
+      }
+    })
+  }
+  for name, path := range watcher.shared {
+    if !seen[name] && watcher.directories[name] == "" {
+      changes = append(changes, &ShareChange{Name: name, Old: watcher.cache[path]})
+      delete(watcher.shared, name)
+      delete(watcher.cache, path)
+    }
+  }
+  // Manifests list the files as just indexed
+  for name, path := range watcher.directories {
+    if change := watcher.indexDirectory(name, path); change != nil {
+      changes = append(changes, change)
+    }
+  }
+  // Forget the files a previous run shared that are gone
+  sharedPaths := make(map[string]bool)
+  for _, path := range watcher.shared {
+    sharedPaths[path] = true
+  }
+  for path := range watcher.cache {
+    if !sharedPaths[path] {
+      delete(watcher.cache, path)
+    }
+  }
+  if len(changes) > 0 {
+    watcher.saveCache()
+  }
+  return changes
+}
+
+// Indexes the file or directory of that name now, whether it changed or not.
+// The files of a directory are indexed too if they weren't, and the manifest
+// listing them is kept up to date by later scans. Like Scan, it reads and
+// hashes the files, so it runs off the event loop.
+func (watcher *ShareWatcher) Index(name string) ([]*ShareChange, error) {
+  watcher.lock.Lock()
+  defer watcher.lock.Unlock()
+  name = strings.TrimSuffix(name, "/")
+  if err := SafePath(name); err != nil {
+    return nil, err
+  }
+  for _, dir := range watcher.Dirs {
+    path := filepath.Join(dir, filepath.FromSlash(name))
+    info, err := StatInside(dir, name)
+    if os.IsNotExist(err) {
+      continue
+    } else if err != nil {
+      return nil, err
+    }
+    if !info.Mode().IsRegular() && !info.IsDir() {
+      return nil, fmt.Errorf("%s is neither a regular file nor a directory", name)
+    }
+    // Forget we shared it, so an unchanged file is given again
+    previous, shared := watcher.shared[name]
+    current := watcher.cache[previous]
+    delete(watcher.shared, name)
+    var changes []*ShareChange
+    if info.IsDir() {
+      walkShared(dir, path, func(fileName, filePath string) {
+        if change, err := watcher.index(fileName, filePath); err != nil {
+          fmt.Println("Can't index", filePath + ":", err)
+        } else if change != nil {
+          changes = append(changes, change)
+        }
+      })
+      watcher.directories[name] = path
+      change := watcher.indexDirectory(name, path)
+      if change == nil || change.New == nil {
+        return nil, fmt.Errorf("%s has no file to share", name)
+      }
+      changes = append(changes, change)
+    } else {
+      change, err := watcher.index(name, path)
+      if err != nil {
+        if shared {
+          watcher.shared[name] = previous
+        }
+        return nil, err
+      }
+      changes = append(changes, change)
+    }
+    changes[len(changes) - 1].Old = current
+    watcher.saveCache()
+    return changes, nil
+  }
+  return nil, fmt.Errorf("%s isn't in any shared directory", name)
+}
+
+// Returns nil if the file at path is already shared as name, unchanged.
+func (watcher *ShareWatcher) index(name, path string) (*ShareChange, error) {
+  info, err := os.Stat(path)
+  if err != nil {
+    return nil, err
+  }
+  cached := watcher.cache[path]
+  fresh := cached != nil && cached.Name == name && cached.Size == info.Size() &&
+    cached.ModTime == info.ModTime().UnixNano() && cached.Chunking == watcher.chunkingMode()
+  if fresh && watcher.shared[name] == path {
+    return nil, nil
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  if int64(len(data)) != info.Size() {
+    return nil, errors.New("file changed while being read")
+  }
+
+  var chunks map[string][]byte
+  if fresh {
+    chunks = cached.split(data)
+  }
+  indexed := cached
+  if chunks == nil {
+    indexed, chunks = watcher.hash(name, data, info.ModTime().UnixNano())
+    indexed.Mode = uint32(info.Mode().Perm())
+  }
+  change := &ShareChange{Name: name, New: indexed, Chunks: chunks}
+  if previous, ok := watcher.shared[name]; ok {
+    change.Old = watcher.cache[previous]
+  }
+  watcher.cache[path] = indexed
+  watcher.shared[name] = path
+  return change, nil
+}
+
+// Builds the manifest of the shared files under the directory name. Returns
+// nil if it didn't change, and withdraws it once the directory is gone.
+func (watcher *ShareWatcher) indexDirectory(name, path string) *ShareChange {
+  var old *FileIndex
+  if previous, ok := watcher.shared[name]; ok {
+    old = watcher.cache[previous]
+  }
+  manifest := &Manifest{}
+  for fileName, filePath := range watcher.shared {
+    index := watcher.cache[filePath]
+    if strings.HasPrefix(fileName, name + "/") && index != nil && !index.Directory {
+      manifest.Entries = append(manifest.Entries, &ManifestEntry{
+        Path: strings.TrimPrefix(fileName, name + "/"),
+        Mode: index.Mode,
+        Size: index.Size,
+        MetaHash: index.MetaHash,
+      })
+    }
+  }
+  if info, err := os.Stat(path); err != nil || !info.IsDir() || len(manifest.Entries) == 0 {
+    delete(watcher.directories, name)
+    delete(watcher.shared, name)
+    delete(watcher.cache, path)
+    if old == nil {
+      return nil
+    }
+    return &ShareChange{Name: name, Old: old}
+  }
+  sort.Slice(manifest.Entries, func(i, j int) bool {
+    return manifest.Entries[i].Path < manifest.Entries[j].Path
+  })
+  indexed, chunks := watcher.hash(name, EncodeManifest(manifest), 0)
+  indexed.Directory = true
+  if old != nil && bytes.Equal(old.MetaHash, indexed.MetaHash) {
+    return nil
+  }
+  watcher.cache[path] = indexed
+  watcher.shared[name] = path
+  return &ShareChange{Name: name, Old: old, New: indexed, Chunks: chunks}
+}
+
+func (watcher *ShareWatcher) hash(name string, data []byte, modTime int64) (*FileIndex, map[string][]byte) {
+  indexed := &FileIndex{
+    Name: name,
+    Size: int64(len(data)),
+    ModTime: modTime,
+    Chunking: watcher.chunkingMode(),
+  }
+  chunks := make(map[string][]byte)
+  for _, chunk := range SplitChunks(data, watcher.ChunkSizes) {
+    chunkHash := sha256.Sum256(chunk)
+    chunks[hex.EncodeToString(chunkHash[:])] = chunk
+    indexed.MetaFile = append(indexed.MetaFile, chunkHash[:]...)
+    indexed.ChunkSizes = append(indexed.ChunkSizes, len(chunk))
+  }
+  metaHash := sha256.Sum256(indexed.MetaFile)
+  indexed.MetaHash = metaHash[:]
+  return indexed, chunks
+}
+
+// Cuts data where it was cut when indexed, without hashing. Returns nil if
+// the cached indexing doesn't fit data.
+func (indexed *FileIndex) split(data []byte) map[string][]byte {
+  if len(indexed.MetaFile) != 32 * len(indexed.ChunkSizes) {
+    return nil
+  }
+  chunks := make(map[string][]byte)
+  offset := 0
+  for i, size := range indexed.ChunkSizes {
+    if size <= 0 || offset + size > len(data) {
+      return nil
+    }
+    chunks[hex.EncodeToString(indexed.MetaFile[i * 32:(i + 1) * 32])] = data[offset:offset + size]
+    offset += size
+  }
+  if offset != len(data) {
+    return nil
+  }
+  return chunks
+}
+
+func (watcher *ShareWatcher) saveCache() {
+  data, err := json.Marshal(watcher.cache)
+  if err == nil {
+    if err = os.MkdirAll(filepath.Dir(watcher.cacheFile), 0755); err == nil {
+      err = writeFileAtomic(watcher.cacheFile, data, 0644)
+    }
+  }
+  if err != nil {
+    fmt.Println("Can't save hash cache:", err)
+  }
+}
+
+// Shares the new version of a file, and withdraws the old one.
+func (gossiper *Gossiper) ApplyShareChange(change *ShareChange) {
+  if change.Old != nil && (change.New == nil || !bytes.Equal(change.Old.MetaHash, change.New.MetaHash)) {
+    gossiper.RemoveFile(hex.EncodeToString(change.Old.MetaHash), change.Name)
+  }
+  if change.New == nil {
+    return
+  }
+  chunks := make(map[string][]byte)
+  for key, chunk := range change.Chunks {
+    chunks[key] = gossiper.StoreChunk(key, chunk)
+  }
+  var metaHash [32]byte
+  copy(metaHash[:], change.New.MetaHash)
+  gossiper.AddFile(change.Name, change.New.Size, metaHash, change.New.MetaFile, chunks, int64(len(change.New.ChunkSizes)))
+  // Directories are registered with a trailing slash, so downloaders know
+  // the file is a manifest
+  name := change.Name
+  if change.New.Directory {
+    gossiper.Files[hex.EncodeToString(change.New.MetaHash)].Directory = true
+    name += "/"
+  }
+  gossiper.PublishName(name, change.New.Size, change.New.MetaHash)
+}
+
+// Stops sharing the file of that metahash if it is named name, and forgets
+// the chunks no other file has.
+func (gossiper *Gossiper) RemoveFile(key, name string) {
+  file := gossiper.Files[key]
+  if file == nil || file.FileName != name {
+    return
+  }
+  delete(gossiper.Files, key)
+  held := make(map[string]bool)
+  for _, other := range gossiper.Files {
+    for hash, chunk := range other.Chunks {
+      if len(chunk) > 0 {
+        held[hash] = true
+      }
+    }
+  }
+  for hash := range file.Chunks {
+    if !held[hash] {
+      delete(gossiper.ChunkStore, hash)
+    }
+  }
+  fmt.Println("WITHDRAWN file", key, name)
+}
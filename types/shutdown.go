@@ -0,0 +1,289 @@
+package types
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "time"
+  "path/filepath"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+)
+
+var STATE_FILE = "state.json"
+var PARTIAL_DIR = "partial"
+
+// What we keep across restarts. Sequence numbers must survive, or peers
+// would take our new messages for ones they already received, and so must
+// the IDs of the privates we received, or replays would be accepted.
+type savedState struct {
+  Peers []string
+  Channels []string
+  Rumors []*RumorMessage // Ours, in ID order, as the next ID follows them
+  PrivateSeq map[string]uint32
+  ReceivedPrivates map[string]*ReceivedIDs
+  SimpleSeq uint32
+  Bans []*BanInfo
+  Commits []*PaxosMessage // Of names agreed by paxos, with their votes
+}
+
+// A download that was interrupted, with the chunks received so far.
+type partialDownload struct {
+  FileName string
+  MetaHash []byte
+  MetaFile []byte
+  Chunks map[string][]byte // By hash, in any order
+  Directory bool
+}
+
+// Whether we are shutting down, so readers can tell a closed socket from a failure.
+func (gossiper *Gossiper) IsStopping() bool {
+  select {
+  case <-gossiper.Quit:
+    return true
+  default:
+    return false
+  }
+}
+
+// Cancels every pending monger, data request, private retry, lookup and
+// proposal timeout, returns how many were cancelled.
+func (gossiper *Gossiper) CancelTimeouts() int {
+  count := 0
+  cancel := func(timeout chan bool) {
+    if timeout != nil {
+      close(timeout)
+      count++
+    }
+  }
+  for peer, timeout := range gossiper.Timeouts {
+    cancel(timeout)
+    delete(gossiper.Timeouts, peer)
+  }
+  for nonce, pending := range gossiper.DataRequests {
+    cancel(pending.timeout)
+    delete(gossiper.DataRequests, nonce)
+  }
+  for _, out := range gossiper.OutgoingPrivates {
+    cancel(out.Timeout)
+    out.Timeout = nil
+  }
+  for nonce, lookup := range gossiper.DHTLookups {
+    cancel(lookup.timeout)
+    delete(gossiper.DHTLookups, nonce)
+  }
+  if gossiper.Consensus != nil {
+    for name, p := range gossiper.Consensus.proposals {
+      cancel(p.timeout)
+      delete(gossiper.Consensus.proposals, name)
+    }
+  }
+  return count
+}
+
+func (gossiper *Gossiper) SaveState(dir string) error {
+  state := savedState{
+    Channels: gossiper.ChannelsAsList(),
+    PrivateSeq: gossiper.PrivateSeq,
+    ReceivedPrivates: gossiper.ReceivedPrivates,
+    SimpleSeq: gossiper.SimpleSeq,
+    Bans: gossiper.Bans(),
+  }
+  if gossiper.Consensus != nil {
+    state.Commits = gossiper.Consensus.Commits()
+  }
+  for id := uint32(1); id < gossiper.GetNextIDForOrigin(gossiper.Name); id++ {
+    state.Rumors = append(state.Rumors, gossiper.GetMessage(gossiper.Name, id))
+  }
+  for _, peer := range gossiper.Peers {
+    state.Peers = append(state.Peers, peer.String())
+  }
+  data, err := json.Marshal(state)
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return err
+  }
+  return writeFileAtomic(filepath.Join(dir, STATE_FILE), data, 0644)
+}
+
+// Restores the state saved by a previous run, if any.
+func (gossiper *Gossiper) LoadState(dir string) error {
+  data, err := os.ReadFile(filepath.Join(dir, STATE_FILE))
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  var state savedState
+  if err := json.Unmarshal(data, &state); err != nil {
+    return err
+  }
+  for _, b := range state.Bans {
+    duration := time.Duration(0)
+    if b.Expires != 0 {
+      if duration = time.Until(time.Unix(b.Expires, 0)); duration <= 0 {
+        continue
+      }
+    }
+    gossiper.Ban(b.Rule, duration)
+  }
+  // Peers that joined have to do it again, the policy may have changed
+  for _, peer := range state.Peers {
+    if address, err := net.ResolveUDPAddr("udp4", peer); err == nil && peer != gossiper.Address.String() &&
+      gossiper.Policy.AdmitsWithoutJoin(address) {
+      gossiper.AddPeer(address)
+    }
+  }
+  for _, channel := range state.Channels {
+    gossiper.JoinChannel(channel)
+  }
+  for _, rm := range state.Rumors {
+    if rm == nil || rm.Origin != gossiper.Name || rm.ID != gossiper.GetNextIDForOrigin(gossiper.Name) {
+      return fmt.Errorf("rumor out of sequence in %s", STATE_FILE)
+    }
+    gossiper.RecordRumor(rm)
+  }
+  for destination, seq := range state.PrivateSeq {
+    gossiper.PrivateSeq[destination] = seq
+  }
+  for origin, ids := range state.ReceivedPrivates {
+    if ids != nil {
+      gossiper.ReceivedPrivates[origin] = ids
+    }
+  }
+  gossiper.SimpleSeq = state.SimpleSeq
+  if gossiper.Consensus != nil {
+    for _, commit := range state.Commits {
+      if !gossiper.Consensus.RestoreCommit(commit) {
+        fmt.Println("IGNORING saved commit that doesn't hold")
+      }
+    }
+  }
+  return nil
+}
+
+// Saves the files being downloaded, returns how many were saved.
+func (gossiper *Gossiper) SavePartialDownloads(dir string) (int, error) {
+  count := 0
+  for key, file := range gossiper.Files {
+    if file.MetaFile == nil || file.IsComplete() {
+      continue
+    }
+    partial := partialDownload{
+      FileName: file.FileName,
+      MetaHash: file.MetaHash,
+      MetaFile: file.MetaFile,
+      Chunks: make(map[string][]byte),
+      Directory: file.Directory,
+    }
+    // Chunks held for other files may be filled past Status
+    for hash, chunk := range file.Chunks {
+      if len(chunk) > 0 {
+        partial.Chunks[hash] = chunk
+      }
+    }
+    data, err := json.Marshal(partial)
+    if err != nil {
+      return count, err
+    }
+    if err := os.MkdirAll(filepath.Join(dir, PARTIAL_DIR), 0755); err != nil {
+      return count, err
+    }
+    if err := writeFileAtomic(filepath.Join(dir, PARTIAL_DIR, key + ".json"), data, 0644); err != nil {
+      return count, err
+    }
+    count++
+  }
+  return count, nil
+}
+
+// Restores the downloads saved by SavePartialDownloads, paused, so they can
+// be served and resumed. They are saved again at the next shutdown if still incomplete.
+func (gossiper *Gossiper) LoadPartialDownloads(dir string) error {
+  paths, err := filepath.Glob(filepath.Join(dir, PARTIAL_DIR, "*.json"))
+  if err != nil {
+    return err
+  }
+  for _, path := range paths {
+    data, err := os.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    var partial partialDownload
+    if err := json.Unmarshal(data, &partial); err != nil || len(partial.MetaFile) % 32 != 0 {
+      fmt.Println("IGNORING corrupted partial download", path)
+      continue
+    }
+    file := &File{
+      FileName: partial.FileName,
+      FileSize: -1,
+      MetaHash: partial.MetaHash,
+      MetaFile: partial.MetaFile,
+      NumChunks: int64(len(partial.MetaFile) / 32),
+      Chunks: make(map[string][]byte),
+      Directory: partial.Directory,
+    }
+    for offset := 0; offset < len(file.MetaFile); offset += 32 {
+      file.Chunks[hex.EncodeToString(file.MetaFile[offset:offset + 32])] = []byte{}
+    }
+    for key, chunk := range partial.Chunks {
+      // Corrupted chunks, or ones of another file, are downloaded again
+      hash := sha256.Sum256(chunk)
+      if _, ok := file.Chunks[key]; ok && len(chunk) > 0 && hex.EncodeToString(hash[:]) == key {
+        file.Chunks[key] = gossiper.StoreChunk(key, chunk)
+      }
+    }
+    // Resumes from the first chunk missing
+    gossiper.FillStoredChunks(file)
+    gossiper.Files[hex.EncodeToString(file.MetaHash)] = file
+    gossiper.addDownload(hex.EncodeToString(file.MetaHash), file.FileName, "", 0, DOWNLOAD_PAUSED)
+    os.Remove(path)
+    fmt.Println("RESTORED partial download of", file.FileName, file.Status, "/", file.NumChunks, "chunks")
+  }
+  return nil
+}
+
+// Writes through a temporary file, so a crash never leaves a truncated one.
+// Temporary files are hidden, so shared directories never share them.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+  tmp, err := os.CreateTemp(filepath.Dir(path), "." + filepath.Base(path) + ".*.tmp")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+  _, err = tmp.Write(data)
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Chmod(tmp.Name(), perm)
+  }
+  if err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), path)
+}
+
+// Waits until every queued packet was sent, or timeout elapsed. Returns the
+// number of packets left behind.
+func (scheduler *SendScheduler) Drain(timeout time.Duration) int {
+  deadline := time.Now().Add(timeout)
+  for {
+    scheduler.lock.Lock()
+    left := 0
+    for _, queued := range scheduler.queued {
+      left += queued
+    }
+    scheduler.lock.Unlock()
+    if left == 0 || time.Now().After(deadline) {
+      return left
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
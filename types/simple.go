@@ -0,0 +1,69 @@
+package types
+
+import (
+  "net"
+  "strconv"
+  "crypto/sha256"
+  "encoding/hex"
+)
+
+var SIMPLE_HOP_LIMIT = uint32(16)
+var MAX_SEEN_SIMPLE = 1024
+
+// Identifies a simple message by origin and ID, or by its contents when the
+// origin doesn't number its messages.
+func (msg *SimpleMessage) Key() string {
+  if msg.ID == 0 {
+    hash := sha256.Sum256([]byte(msg.Contents))
+    return msg.OriginalName + "/" + hex.EncodeToString(hash[:])
+  }
+  return msg.OriginalName + "/" + strconv.FormatUint(uint64(msg.ID), 10)
+}
+
+// Records a simple message as seen, returns false if it already was.
+func (gossiper *Gossiper) markSimpleSeen(msg *SimpleMessage) bool {
+  key := msg.Key()
+  if gossiper.SeenSimple[key] {
+    return false
+  }
+  gossiper.SeenSimple[key] = true
+  gossiper.SeenSimpleOrder = append(gossiper.SeenSimpleOrder, key)
+  if len(gossiper.SeenSimpleOrder) > MAX_SEEN_SIMPLE {
+    delete(gossiper.SeenSimple, gossiper.SeenSimpleOrder[0])
+    gossiper.SeenSimpleOrder = gossiper.SeenSimpleOrder[1:]
+  }
+  return true
+}
+
+func (gossiper *Gossiper) SendSimple(text string) {
+  gossiper.SimpleSeq++
+  msg := &SimpleMessage{
+    OriginalName: gossiper.Name,
+    RelayPeerAddr: gossiper.Address.String(),
+    Contents: text,
+    ID: gossiper.SimpleSeq,
+    HopLimit: SIMPLE_HOP_LIMIT,
+  }
+  gossiper.markSimpleSeen(msg)
+  gossiper.ForwardToAllPeers(nil, &GossipPacket{Simple: msg})
+}
+
+// Relays a simple message to every peer but sender, once, until its hop limit runs out.
+func (gossiper *Gossiper) ReceiveSimple(msg *SimpleMessage, sender *net.UDPAddr) {
+  msg.RelayPeerAddr = sender.String()
+  msg.Log()
+  if msg.OriginalName == gossiper.Name || !gossiper.markSimpleSeen(msg) {
+    return
+  }
+  hopLimit := msg.HopLimit
+  if hopLimit == 0 {
+    hopLimit = SIMPLE_HOP_LIMIT
+  }
+  if hopLimit <= 1 {
+    return
+  }
+  forwarded := *msg
+  forwarded.RelayPeerAddr = gossiper.Address.String()
+  forwarded.HopLimit = hopLimit - 1
+  gossiper.ForwardToAllPeers(sender, &GossipPacket{Simple: &forwarded})
+}
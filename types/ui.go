@@ -0,0 +1,147 @@
+package types
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "github.com/dedis/protobuf"
+  "github.com/nt1m/Peerster/utils"
+)
+
+var UI_PROTOCOL_VERSION = uint32(1)
+var UI_REPLY_TIMEOUT = 2 * time.Second
+
+const (
+  UI_ERROR_BAD_REQUEST = "bad_request"
+  UI_ERROR_UNSUPPORTED_VERSION = "unsupported_version"
+  UI_ERROR_FILE_NOT_FOUND = "file_not_found"
+  UI_ERROR_UNKNOWN_DESTINATION = "unknown_destination"
+  UI_ERROR_INVALID_CHANNEL = "invalid_channel"
+  UI_ERROR_INTERNAL = "internal"
+)
+
+type SendCommand struct {
+  Text string
+  Destination string // Private message if set
+  Channel string
+  Onion bool // Private message over a circuit
+}
+
+type ShareCommand struct {
+  File string
+}
+
+type DownloadCommand struct {
+  File string
+  Destination string
+  Request string // Hex encoded metahash, resolved from File through the chain if empty
+}
+
+type ChannelCommand struct {
+  Channel string
+}
+
+// Sent by UI clients to the gossiper, which answers with a UIReply of the same ID.
+// Exactly one command is set.
+type UIRequest struct {
+  Version uint32
+  ID uint32
+  Send *SendCommand
+  Share *ShareCommand
+  Download *DownloadCommand
+  Join *ChannelCommand
+  Leave *ChannelCommand
+}
+
+type UIError struct {
+  Code string
+  Message string
+}
+
+type UIReply struct {
+  Version uint32
+  ID uint32
+  Error *UIError
+  Queued bool // Accepted, but waiting for a route to the destination
+}
+
+func NewUIError(code string, format string, args ...interface{}) *UIError {
+  return &UIError{code, fmt.Sprintf(format, args...)}
+}
+
+func (err *UIError) Error() string {
+  return err.Code + ": " + err.Message
+}
+
+// Converts the flat message used by the REST API and the legacy client flags.
+// A message asking for several things converts to a request with several
+// commands, which the gossiper rejects rather than guess which one was meant.
+func (msg *Message) ToUIRequest(id uint32) *UIRequest {
+  rq := &UIRequest{Version: UI_PROTOCOL_VERSION, ID: id}
+  if msg.File != "" && (msg.Request != "" || msg.Destination != "") {
+    rq.Download = &DownloadCommand{msg.File, msg.Destination, msg.Request}
+  } else if msg.File != "" {
+    rq.Share = &ShareCommand{msg.File}
+  }
+  if msg.Join != "" {
+    rq.Join = &ChannelCommand{msg.Join}
+  }
+  if msg.Leave != "" {
+    rq.Leave = &ChannelCommand{msg.Leave}
+  }
+  if msg.Text != "" {
+    rq.Send = &SendCommand{msg.Text, msg.Destination, msg.Channel, msg.Onion}
+  }
+  return rq
+}
+
+func (rq *UIRequest) CommandCount() int {
+  count := 0
+  for _, set := range []bool{rq.Send != nil, rq.Share != nil, rq.Download != nil, rq.Join != nil, rq.Leave != nil} {
+    if set {
+      count++
+    }
+  }
+  return count
+}
+
+func EncodeUIRequest(rq *UIRequest) []byte {
+  bytes, err := protobuf.Encode(rq)
+  utils.CheckError(err)
+  return bytes
+}
+
+func EncodeUIReply(rp *UIReply) []byte {
+  bytes, err := protobuf.Encode(rp)
+  utils.CheckError(err)
+  return bytes
+}
+
+// Sends a request to the UI port at address and waits for the gossiper's reply.
+func SendUIRequest(address string, rq *UIRequest) (*UIReply, error) {
+  conn, err := net.Dial("udp4", address)
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+  if _, err := conn.Write(EncodeUIRequest(rq)); err != nil {
+    return nil, err
+  }
+
+  conn.SetReadDeadline(time.Now().Add(UI_REPLY_TIMEOUT))
+  buf := make([]byte, 16384)
+  for {
+    n, err := conn.Read(buf)
+    if err != nil {
+      return nil, err
+    }
+    var reply UIReply
+    if protobuf.Decode(buf[:n], &reply) != nil {
+      continue
+    }
+    // Malformed requests are answered with ID 0
+    if reply.ID == rq.ID || reply.ID == 0 {
+      return &reply, nil
+    }
+  }
+}
@@ -0,0 +1,257 @@
+package types
+
+import (
+  "fmt"
+  "crypto/sha256"
+)
+
+var MAX_HOP_LIMIT = uint32(64)
+var MAX_NAME_LENGTH = 255 // Origins and file names
+var MAX_STATUS_ENTRIES = 1024
+var MAX_BLOCK_TRANSACTIONS = 256
+
+type InvalidPacketError struct {
+  Variant string // Packet field at fault, or why the packet couldn't be read at all
+  Reason string
+}
+
+func (err *InvalidPacketError) Error() string {
+  return err.Variant + ": " + err.Reason
+}
+
+func invalid(variant, format string, args ...interface{}) *InvalidPacketError {
+  return &InvalidPacketError{variant, fmt.Sprintf(format, args...)}
+}
+
+// Decrements a hop limit, returns false if the packet must not travel further.
+func DecrementHopLimit(hopLimit *uint32) bool {
+  if *hopLimit <= 1 {
+    *hopLimit = 0
+    return false
+  }
+  *hopLimit--
+  return true
+}
+
+func checkName(variant, field, name string) *InvalidPacketError {
+  if name == "" || len(name) > MAX_NAME_LENGTH {
+    return invalid(variant, "%s must have 1 to %d bytes", field, MAX_NAME_LENGTH)
+  }
+  return nil
+}
+
+func checkHash(variant, field string, hash []byte) *InvalidPacketError {
+  if len(hash) != sha256.Size {
+    return invalid(variant, "%s has %d bytes instead of %d", field, len(hash), sha256.Size)
+  }
+  return nil
+}
+
+// Routed packets must be able to travel at least one hop, unless allowZero is
+// set for peers that don't set hop limits on that kind of packet.
+func checkHopLimit(variant string, hopLimit uint32, allowZero bool) *InvalidPacketError {
+  if hopLimit > MAX_HOP_LIMIT || hopLimit == 0 && !allowZero {
+    return invalid(variant, "hop limit %d is out of range", hopLimit)
+  }
+  return nil
+}
+
+// Returns the first error in the list, if any.
+func firstError(errs ...*InvalidPacketError) *InvalidPacketError {
+  for _, err := range errs {
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Checks that exactly one variant is set, and that it is well-formed enough
+// for the handlers to process without further bounds checks.
+func (packet *GossipPacket) Validate() *InvalidPacketError {
+  set := 0
+  for _, isSet := range []bool{
+    packet.Simple != nil, packet.Rumor != nil, packet.Status != nil, packet.Private != nil,
+    packet.DataRequest != nil, packet.DataReply != nil, packet.Gap != nil, packet.PrivateAck != nil,
+    packet.Mail != nil, packet.TxPublish != nil, packet.BlockPublish != nil, packet.Paxos != nil,
+    packet.DHT != nil, packet.ChunkMapRequest != nil, packet.ChunkMapReply != nil,
+    packet.JoinChallenge != nil, packet.JoinRequest != nil, packet.Onion != nil, packet.BlockRequest != nil,
+  } {
+    if isSet {
+      set++
+    }
+  }
+  if set != 1 {
+    return invalid("packet", "%d variants are set instead of 1", set)
+  }
+
+  switch {
+  case packet.Simple != nil:
+    msg := packet.Simple
+    return firstError(
+      checkName("Simple", "OriginalName", msg.OriginalName),
+      // Peers that don't number their messages don't set hop limits either
+      checkHopLimit("Simple", msg.HopLimit, true))
+  case packet.Rumor != nil:
+    rm := packet.Rumor
+    if rm.ID == 0 {
+      return invalid("Rumor", "IDs start at 1")
+    }
+    if len(rm.OnionKey) != 0 && len(rm.OnionKey) != ONION_KEY_SIZE {
+      return invalid("Rumor", "onion key has %d bytes instead of %d", len(rm.OnionKey), ONION_KEY_SIZE)
+    }
+    if len(rm.MailKey) != 0 && len(rm.MailKey) != ONION_KEY_SIZE {
+      return invalid("Rumor", "mail key has %d bytes instead of %d", len(rm.MailKey), ONION_KEY_SIZE)
+    }
+    if rm.Channel != "" && !IsValidChannelName(rm.Channel) {
+      return invalid("Rumor", "invalid channel name %q", rm.Channel)
+    }
+    return checkName("Rumor", "Origin", rm.Origin)
+  case packet.Status != nil:
+    if len(packet.Status.Want) > MAX_STATUS_ENTRIES {
+      return invalid("Status", "%d entries is more than %d", len(packet.Status.Want), MAX_STATUS_ENTRIES)
+    }
+    for _, status := range packet.Status.Want {
+      if err := checkName("Status", "Identifier", status.Identifier); err != nil {
+        return err
+      }
+    }
+  case packet.Private != nil:
+    return validatePrivate(packet.Private)
+  case packet.DataRequest != nil:
+    rq := packet.DataRequest
+    return firstError(
+      checkName("DataRequest", "Origin", rq.Origin),
+      checkName("DataRequest", "Destination", rq.Destination),
+      checkHopLimit("DataRequest", rq.HopLimit, false),
+      checkHash("DataRequest", "HashValue", rq.HashValue))
+  case packet.DataReply != nil:
+    rp := packet.DataReply
+    if len(rp.Data) > MAX_PACKET_SIZE {
+      return invalid("DataReply", "%d bytes of data is more than %d", len(rp.Data), MAX_PACKET_SIZE)
+    }
+    return firstError(
+      checkName("DataReply", "Origin", rp.Origin),
+      checkName("DataReply", "Destination", rp.Destination),
+      // Replies used not to carry a hop limit
+      checkHopLimit("DataReply", rp.HopLimit, true),
+      checkHash("DataReply", "HashValue", rp.HashValue))
+  case packet.Gap != nil:
+    if len(packet.Gap.IDs) > MAX_GAP_REQUEST_IDS {
+      return invalid("Gap", "%d IDs is more than %d", len(packet.Gap.IDs), MAX_GAP_REQUEST_IDS)
+    }
+    return checkName("Gap", "Origin", packet.Gap.Origin)
+  case packet.PrivateAck != nil:
+    ack := packet.PrivateAck
+    return firstError(
+      checkName("PrivateAck", "Origin", ack.Origin),
+      checkName("PrivateAck", "Destination", ack.Destination),
+      checkHopLimit("PrivateAck", ack.HopLimit, false))
+  case packet.Mail != nil:
+    mail := packet.Mail
+    if len(mail.Sealed) == 0 || len(mail.Sealed) > MAX_PACKET_SIZE {
+      return invalid("Mail", "%d bytes of sealed message", len(mail.Sealed))
+    }
+    return firstError(
+      checkName("Mail", "Destination", mail.Destination),
+      checkName("Mail", "Recipient", mail.Recipient),
+      checkHopLimit("Mail", mail.HopLimit, false))
+  case packet.TxPublish != nil:
+    return firstError(
+      validateClaim("TxPublish", packet.TxPublish),
+      checkHopLimit("TxPublish", packet.TxPublish.HopLimit, false))
+  case packet.BlockPublish != nil:
+    bp := packet.BlockPublish
+    if len(bp.Block.Transactions) > MAX_BLOCK_TRANSACTIONS {
+      return invalid("BlockPublish", "%d transactions is more than %d", len(bp.Block.Transactions), MAX_BLOCK_TRANSACTIONS)
+    }
+    for i := range bp.Block.Transactions {
+      if err := validateClaim("BlockPublish", &bp.Block.Transactions[i]); err != nil {
+        return err
+      }
+    }
+    return checkHopLimit("BlockPublish", bp.HopLimit, false)
+  case packet.BlockRequest != nil:
+    if len(packet.BlockRequest.Hash) == 0 {
+      return nil
+    }
+    return checkHash("BlockRequest", "Hash", packet.BlockRequest.Hash)
+  case packet.Paxos != nil:
+    msg := packet.Paxos
+    if msg.Type < PAXOS_PROPOSE || msg.Type > PAXOS_PROMISE {
+      return invalid("Paxos", "unknown type %d", msg.Type)
+    }
+    if len(msg.Votes) > MAX_PAXOS_VOTES {
+      return invalid("Paxos", "too many votes")
+    }
+    return firstError(
+      checkName("Paxos", "Origin", msg.Origin),
+      checkName("Paxos", "Proposer", msg.Proposer),
+      validateClaim("Paxos", &msg.Claim),
+      checkHopLimit("Paxos", msg.HopLimit, false))
+  case packet.DHT != nil:
+    msg := packet.DHT
+    if msg.Type < DHT_STORE || msg.Type > DHT_FOUND {
+      return invalid("DHT", "unknown type %d", msg.Type)
+    }
+    if len(msg.Providers) > MAX_PROVIDERS_PER_KEY || len(msg.Closer) > DHT_K {
+      return invalid("DHT", "too many providers or closer nodes")
+    }
+    return firstError(
+      checkName("DHT", "Origin", msg.Origin),
+      checkName("DHT", "Destination", msg.Destination),
+      checkHopLimit("DHT", msg.HopLimit, false),
+      checkHash("DHT", "Key", msg.Key))
+  case packet.ChunkMapRequest != nil:
+    rq := packet.ChunkMapRequest
+    return firstError(
+      checkName("ChunkMapRequest", "Origin", rq.Origin),
+      checkName("ChunkMapRequest", "Destination", rq.Destination),
+      checkHopLimit("ChunkMapRequest", rq.HopLimit, false),
+      checkHash("ChunkMapRequest", "MetaHash", rq.MetaHash))
+  case packet.ChunkMapReply != nil:
+    rp := packet.ChunkMapReply
+    if int64(len(rp.Bitmap)) != (int64(rp.NumChunks) + 7) / 8 {
+      return invalid("ChunkMapReply", "bitmap of %d bytes for %d chunks", len(rp.Bitmap), rp.NumChunks)
+    }
+    return firstError(
+      checkName("ChunkMapReply", "Origin", rp.Origin),
+      checkName("ChunkMapReply", "Destination", rp.Destination),
+      checkHopLimit("ChunkMapReply", rp.HopLimit, false),
+      checkHash("ChunkMapReply", "MetaHash", rp.MetaHash))
+  case packet.Onion != nil:
+    if len(packet.Onion.Data) == 0 || len(packet.Onion.Data) > MAX_PACKET_SIZE {
+      return invalid("Onion", "%d bytes of data", len(packet.Onion.Data))
+    }
+    return firstError(
+      checkName("Onion", "Destination", packet.Onion.Destination),
+      checkHopLimit("Onion", packet.Onion.HopLimit, false))
+  case packet.JoinChallenge != nil || packet.JoinRequest != nil:
+    return validateJoin(packet)
+  }
+  return nil
+}
+
+func validatePrivate(pm *PrivateMessage) *InvalidPacketError {
+  return firstError(
+    checkName("Private", "Origin", pm.Origin),
+    checkName("Private", "Destination", pm.Destination),
+    checkHopLimit("Private", pm.HopLimit, false))
+}
+
+func validateClaim(variant string, tx *TxPublish) *InvalidPacketError {
+  return firstError(
+    checkName(variant, "Name", tx.Name),
+    checkHash(variant, "MetafileHash", tx.MetafileHash))
+}
+
+// Whether data can be the metafile of a file: a non-empty list of chunk hashes.
+func IsValidMetaFile(data []byte) bool {
+  return len(data) > 0 && len(data) % sha256.Size == 0
+}
+
+// Counts and logs a packet we won't process.
+func (gossiper *Gossiper) RejectPacket(sender string, err *InvalidPacketError) {
+  gossiper.Rejected[err.Variant]++
+  fmt.Println("REJECTED packet from", sender, err.Error())
+}
@@ -0,0 +1,26 @@
+package types
+
+import (
+  "math"
+  "testing"
+)
+
+// Bitmap sizes are computed without overflowing, even for the largest count.
+func TestChunkMapReplyBitmapSize(t *testing.T) {
+  reply := func(numChunks uint32, bitmap []byte) *GossipPacket {
+    return &GossipPacket{ChunkMapReply: &ChunkMapReply{
+      Origin: "A",
+      Destination: "B",
+      HopLimit: 10,
+      MetaHash: make([]byte, 32),
+      NumChunks: numChunks,
+      Bitmap: bitmap,
+    }}
+  }
+  if reply(math.MaxUint32, []byte{}).Validate() == nil {
+    t.Error("empty bitmap accepted for", uint32(math.MaxUint32), "chunks")
+  }
+  if err := reply(9, []byte{0xff, 0x80}).Validate(); err != nil {
+    t.Error("valid bitmap rejected:", err)
+  }
+}
@@ -0,0 +1,234 @@
+package webserver
+
+import (
+  "net"
+  "sync"
+  "time"
+  "strings"
+  "net/url"
+  "net/http"
+  "crypto/rand"
+  "crypto/subtle"
+  "encoding/hex"
+  "encoding/json"
+)
+
+const (
+  ROLE_NONE = iota
+  ROLE_READ // Can use GET endpoints
+  ROLE_ADMIN // Can use every endpoint
+)
+
+var SESSION_COOKIE = "peerster_session"
+var CSRF_COOKIE = "peerster_csrf" // Readable by the UI, which echoes it in CSRF_HEADER
+var CSRF_HEADER = "X-CSRF-Token"
+var SESSION_TTL = 12 * time.Hour
+
+type WebConfig struct {
+  BindAddr string
+  Port string
+  AdminToken string // No authentication if both tokens are empty
+  ReadToken string
+  TLS bool // Serve HTTPS with the certificate of CertDir, generated if missing
+  CertDir string
+}
+
+type session struct {
+  role int
+  csrf string
+  expires time.Time
+}
+
+var sessions = struct {
+  lock sync.Mutex
+  byID map[string]*session
+}{byID: make(map[string]*session)}
+
+func RandomToken() string {
+  bytes := make([]byte, 16)
+  rand.Read(bytes)
+  return hex.EncodeToString(bytes)
+}
+
+func IsLoopback(bindAddr string) bool {
+  ip := net.ParseIP(bindAddr)
+  return bindAddr == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+func authEnabled() bool {
+  return config.AdminToken != "" || config.ReadToken != ""
+}
+
+func roleName(role int) string {
+  switch role {
+  case ROLE_ADMIN:
+    return "admin"
+  case ROLE_READ:
+    return "read"
+  }
+  return ""
+}
+
+func tokenRole(token string) int {
+  if token == "" {
+    return ROLE_NONE
+  }
+  if config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1 {
+    return ROLE_ADMIN
+  }
+  if config.ReadToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.ReadToken)) == 1 {
+    return ROLE_READ
+  }
+  return ROLE_NONE
+}
+
+// Returns the session of the request's cookie, if it is still valid.
+func sessionOf(r *http.Request) *session {
+  cookie, err := r.Cookie(SESSION_COOKIE)
+  if err != nil {
+    return nil
+  }
+  sessions.lock.Lock()
+  defer sessions.lock.Unlock()
+  s := sessions.byID[cookie.Value]
+  if s != nil && time.Now().After(s.expires) {
+    delete(sessions.byID, cookie.Value)
+    return nil
+  }
+  return s
+}
+
+func isReadOnly(method string) bool {
+  return method == "GET" || method == "HEAD"
+}
+
+// Whether a browser sent the request from a page of another site. Clients
+// other than browsers send neither header.
+func isCrossSite(r *http.Request) bool {
+  if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+    return site != "same-origin" && site != "none"
+  }
+  if origin := r.Header.Get("Origin"); origin != "" {
+    u, err := url.Parse(origin)
+    return err != nil || u.Host != r.Host
+  }
+  return false
+}
+
+// Lets a request through if its bearer token or session grants the role the
+// endpoint needs: read for GET, admin otherwise. Browsers send cookies on
+// their own, so session requests that change anything must also carry the
+// session's CSRF token. Without authentication, any site the browser visits
+// could still post to us, so cross-site requests that change anything are refused.
+func RequireRole(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !authEnabled() {
+      if !isReadOnly(r.Method) && isCrossSite(r) {
+        http.Error(w, "cross-site request refused", http.StatusForbidden)
+        return
+      }
+      next.ServeHTTP(w, r)
+      return
+    }
+    needed := ROLE_ADMIN
+    if isReadOnly(r.Method) {
+      needed = ROLE_READ
+    }
+
+    role := ROLE_NONE
+    if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+      role = tokenRole(strings.TrimPrefix(header, "Bearer "))
+    } else if s := sessionOf(r); s != nil {
+      if !isReadOnly(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRF_HEADER)), []byte(s.csrf)) != 1 {
+        http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+        return
+      }
+      role = s.role
+    }
+
+    if role == ROLE_NONE {
+      http.Error(w, "authentication required", http.StatusUnauthorized)
+    } else if role < needed {
+      http.Error(w, "admin permission required", http.StatusForbidden)
+    } else {
+      next.ServeHTTP(w, r)
+    }
+  })
+}
+
+// Exchanges a token for a session cookie, so the browser UI doesn't keep the token.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+  var login struct {
+    Token string
+  }
+  if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+    http.Error(w, "invalid JSON: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  role := tokenRole(login.Token)
+  if role == ROLE_NONE {
+    http.Error(w, "invalid token", http.StatusUnauthorized)
+    return
+  }
+
+  id := RandomToken()
+  s := &session{role, RandomToken(), time.Now().Add(SESSION_TTL)}
+  sessions.lock.Lock()
+  sessions.byID[id] = s
+  sessions.lock.Unlock()
+
+  http.SetCookie(w, &http.Cookie{
+    Name: SESSION_COOKIE,
+    Value: id,
+    Path: "/",
+    Expires: s.expires,
+    HttpOnly: true,
+    Secure: config.TLS,
+    SameSite: http.SameSiteStrictMode,
+  })
+  http.SetCookie(w, &http.Cookie{
+    Name: CSRF_COOKIE,
+    Value: s.csrf,
+    Path: "/",
+    Expires: s.expires,
+    Secure: config.TLS,
+    SameSite: http.SameSiteStrictMode,
+  })
+  writeSession(w, s)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+  if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+    sessions.lock.Lock()
+    delete(sessions.byID, cookie.Value)
+    sessions.lock.Unlock()
+  }
+  for _, name := range []string{SESSION_COOKIE, CSRF_COOKIE} {
+    http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+// Tells the UI whether it has to log in, and what it is allowed to do.
+func SessionGetHandler(w http.ResponseWriter, r *http.Request) {
+  if !authEnabled() {
+    writeSession(w, &session{role: ROLE_ADMIN})
+    return
+  }
+  s := sessionOf(r)
+  if s == nil {
+    s = &session{role: ROLE_NONE}
+  }
+  writeSession(w, s)
+}
+
+func writeSession(w http.ResponseWriter, s *session) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+  json, _ := json.Marshal(&struct {
+    AuthEnabled bool
+    Role string
+    CSRF string
+  }{authEnabled(), roleName(s.role), s.csrf})
+  w.Write(json)
+}
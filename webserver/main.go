@@ -2,13 +2,17 @@ package webserver
 
 import (
   "net"
+  "time"
+  "context"
+  "math/rand"
   "net/http"
   "encoding/json"
   "fmt"
   "io"
   "bytes"
+  "encoding/hex"
+  "strings"
   "github.com/gorilla/mux"
-  "github.com/dedis/protobuf"
   . "github.com/nt1m/Peerster/types"
 )
 
@@ -17,64 +21,226 @@ type ReturnedFile struct {
   Hash string
 }
 
-var gossiper *Gossiper
-var port string
+type ReturnedName struct {
+  Name string
+  Size int64
+  Hash string
+}
+
+// Settings of a gossiper started through the web server
+type NodeConfig struct {
+  Name string
+  GossipAddr string
+  Peers string // Comma separated ip:port
+}
 
-func NewWebServer(p string, g *Gossiper) {
-  gossiper = g
-  port = p
+// Gossipers hosted by the process the web server runs in.
+type NodeManager interface {
+  Primary() *Gossiper
+  Node(name string) *Gossiper // nil if there is none of that name
+  Names() []string
+  AddNode(config *NodeConfig) (*Gossiper, error)
+  RemoveNode(name string) error
+}
+
+var nodes NodeManager
+var config *WebConfig
+var server *http.Server
+
+func NewWebServer(c *WebConfig, manager NodeManager) {
+  nodes = manager
+  config = c
 
   router := mux.NewRouter()
+  router.HandleFunc("/login", LoginHandler).Methods("POST")
+  router.HandleFunc("/logout", LogoutHandler).Methods("POST")
+  router.HandleFunc("/session", SessionGetHandler).Methods("GET")
+
+  // Everything but the login and the static UI needs permission
+  api := router.NewRoute().Subrouter()
+  api.Use(RequireRole)
+  api.HandleFunc("/nodes", NodesGetHandler).Methods("GET")
+  api.HandleFunc("/nodes", NodesPostHandler).Methods("POST")
+  api.HandleFunc("/nodes/{node}", NodeDeleteHandler).Methods("DELETE")
+
+  // Every node is served under /nodes/{node}, and the primary one at the root too
+  nodeRouter := api.PathPrefix("/nodes/{node}").Subrouter()
+  nodeRouter.Use(RequireNode)
+  addNodeRoutes(nodeRouter)
+  addNodeRoutes(api)
+
+  router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+
+  server = &http.Server{Addr: net.JoinHostPort(config.BindAddr, config.Port), Handler: router}
+  var err error
+  if config.TLS {
+    certFile, keyFile, certErr := LoadOrCreateCertificate(config.CertDir, config.BindAddr)
+    if certErr != nil {
+      fmt.Println("Can't load TLS certificate:", certErr)
+      return
+    }
+    fmt.Println("Serving web server at: https://" + server.Addr, "with certificate", certFile)
+    err = server.ListenAndServeTLS(certFile, keyFile)
+  } else {
+    fmt.Println("Serving web server at:", server.Addr)
+    err = server.ListenAndServe()
+  }
+  if err != http.ErrServerClosed {
+    fmt.Println("Web server stopped:", err)
+  }
+}
+
+func addNodeRoutes(router *mux.Router) {
   router.HandleFunc("/message", MessageGetHandler).Methods("GET")
   router.HandleFunc("/message", MessagePostHandler).Methods("POST")
 
   router.HandleFunc("/destination", DestinationGetHandler).Methods("GET")
+  router.HandleFunc("/route", RouteGetHandler).Methods("GET")
 
   router.HandleFunc("/node", NodeGetHandler).Methods("GET")
   router.HandleFunc("/node", NodePostHandler).Methods("POST")
 
   router.HandleFunc("/file", FileGetHandler).Methods("GET")
+  router.HandleFunc("/file/{hash}/chunks", FileChunksGetHandler).Methods("GET")
+  router.HandleFunc("/name", NameGetHandler).Methods("GET")
+  router.HandleFunc("/consensus", ConsensusGetHandler).Methods("GET")
+  router.HandleFunc("/rejected", RejectedGetHandler).Methods("GET")
+  router.HandleFunc("/link", LinkGetHandler).Methods("GET")
+  router.HandleFunc("/bans", BansGetHandler).Methods("GET")
+  router.HandleFunc("/bans", BansPostHandler).Methods("POST")
+  // Rules can be CIDRs, which contain a slash
+  router.HandleFunc("/bans/{rule:.+}", BanDeleteHandler).Methods("DELETE")
+  router.HandleFunc("/downloads", DownloadsGetHandler).Methods("GET")
+  router.HandleFunc("/downloads/{hash}", DownloadDeleteHandler).Methods("DELETE")
+  router.HandleFunc("/downloads/{hash}/pause", DownloadPauseHandler).Methods("POST")
+  router.HandleFunc("/downloads/{hash}/resume", DownloadResumeHandler).Methods("POST")
+  router.HandleFunc("/downloads/{hash}/priority", DownloadPriorityHandler).Methods("PUT")
+
+  router.HandleFunc("/channel", ChannelGetHandler).Methods("GET")
+  router.HandleFunc("/channel", ChannelPostHandler).Methods("POST")
+  router.HandleFunc("/channel/{name}", ChannelDeleteHandler).Methods("DELETE")
+  router.HandleFunc("/channel/{name}/message", ChannelMessageGetHandler).Methods("GET")
 
   router.HandleFunc("/id", IdGetHandler).Methods("GET")
-  router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+}
+
+// The gossiper a request is about: the one named in its path, or the primary one.
+func gossiperFor(r *http.Request) *Gossiper {
+  if name, ok := mux.Vars(r)["node"]; ok {
+    return nodes.Node(name)
+  }
+  return nodes.Primary()
+}
 
-  http.Handle("/", router)
-  fmt.Println("Serving web server at:", port)
-  http.ListenAndServe(":" + port, nil)
+func RequireNode(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if gossiperFor(r) == nil {
+      http.Error(w, "unknown node", http.StatusNotFound)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
 }
 
-func MessageGetHandler(w http.ResponseWriter, r *http.Request) {
-  w.WriteHeader(http.StatusOK)
+func NodesGetHandler(w http.ResponseWriter, r *http.Request) {
   w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
 
+  json, err := json.Marshal(nodes.Names())
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+func NodesPostHandler(w http.ResponseWriter, r *http.Request) {
+  var config NodeConfig
+  if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+    http.Error(w, "invalid JSON: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  if _, err := nodes.AddNode(&config); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  w.WriteHeader(http.StatusCreated)
+}
+
+func NodeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+  if err := nodes.RemoveNode(mux.Vars(r)["node"]); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+// Stops accepting connections and waits for the requests being served, up to timeout.
+func StopWebServer(timeout time.Duration) error {
+  if server == nil {
+    return nil
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+  return server.Shutdown(ctx)
+}
+
+func MessageGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   str := "["
-  i := 0
-  for _, message := range gossiper.VisibleMessages {
-    if i > 0 {
-      str += ","
+  if !gossiper.Do(func() {
+    for i, message := range gossiper.VisibleMessages {
+      if i > 0 {
+        str += ","
+      }
+      str += gossiper.MessageToJSON(message)
     }
-    str += message.ToJSON()
-    i++
+  }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
   }
   str += "]"
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
   io.WriteString(w, str)
 }
 
 func MessagePostHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   decoder := json.NewDecoder(r.Body)
   var msg Message
-  err := decoder.Decode(&msg)
-  packetBytes, err := protobuf.Encode(&msg)
-  FailIfErr(w, http.StatusBadRequest, err)
-  conn, err := net.Dial("udp4", "127.0.0.1:" + port)
-  FailIfErr(w, http.StatusBadRequest, err)
-  if err == nil {
-    conn.Write(packetBytes)
+  if err := decoder.Decode(&msg); err != nil {
+    WriteUIError(w, NewUIError(UI_ERROR_BAD_REQUEST, "invalid JSON: %v", err))
+    return
+  }
+  reply, err := SendUIRequest(gossiper.UIAddress, msg.ToUIRequest(rand.Uint32() | 1))
+  if err != nil {
+    WriteUIError(w, NewUIError(UI_ERROR_INTERNAL, "no reply from gossiper: %v", err))
+    return
+  }
+  if reply.Error != nil {
+    WriteUIError(w, reply.Error)
+  } else if reply.Queued {
+    w.WriteHeader(http.StatusAccepted)
+  } else {
     w.WriteHeader(http.StatusOK)
   }
 }
 
+// Replies with the HTTP status matching the error code, and the error as JSON.
+func WriteUIError(w http.ResponseWriter, uiErr *UIError) {
+  statusCode := http.StatusInternalServerError
+  switch uiErr.Code {
+  case UI_ERROR_BAD_REQUEST, UI_ERROR_UNSUPPORTED_VERSION, UI_ERROR_INVALID_CHANNEL:
+    statusCode = http.StatusBadRequest
+  case UI_ERROR_FILE_NOT_FOUND, UI_ERROR_UNKNOWN_DESTINATION:
+    statusCode = http.StatusNotFound
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(statusCode)
+  json, _ := json.Marshal(uiErr)
+  w.Write(json)
+}
+
 func DestinationGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   w.WriteHeader(http.StatusOK)
   w.Header().Set("Content-Type", "application/json")
   destinations := make([]string, 0, len(gossiper.Router))
@@ -87,7 +253,22 @@ func DestinationGetHandler(w http.ResponseWriter, r *http.Request) {
   io.WriteString(w, string(json))
 }
 
+func RouteGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  w.WriteHeader(http.StatusOK)
+  w.Header().Set("Content-Type", "application/json")
+  routes := make(map[string]string)
+  for destination, address := range gossiper.Router {
+    routes[destination] = address.String()
+  }
+
+  json, err := json.Marshal(&routes)
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
 func NodeGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   w.WriteHeader(http.StatusOK)
   w.Header().Set("Content-Type", "application/json")
 
@@ -95,6 +276,7 @@ func NodeGetHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func NodePostHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   buf := new(bytes.Buffer)
   buf.ReadFrom(r.Body)
   str := buf.String()
@@ -109,12 +291,14 @@ func NodePostHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func IdGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   w.WriteHeader(http.StatusOK)
   w.Header().Set("Content-Type", "text/plain")
   io.WriteString(w, gossiper.Name)
 }
 
 func FileGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
   w.WriteHeader(http.StatusOK)
   w.Header().Set("Content-Type", "application/json")
 
@@ -127,6 +311,306 @@ func FileGetHandler(w http.ResponseWriter, r *http.Request) {
   io.WriteString(w, string(json))
 }
 
+// Chunks of a file held by us and by the peers that told us
+func FileChunksGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  hash := mux.Vars(r)["hash"]
+  found := false
+  var data []byte
+  var err error
+  // Chunks and chunk maps arrive on the loop, so they are encoded on it
+  if !gossiper.Do(func() {
+    file := gossiper.Files[hash]
+    if found = file != nil; !found {
+      return
+    }
+    peers := gossiper.PeerChunkMaps[hash]
+    if peers == nil {
+      peers = map[string][]byte{}
+    }
+    data, err = json.Marshal(&struct {
+      NumChunks int
+      Bitmap []byte
+      Peers map[string][]byte
+    }{len(file.MetaFile) / 32, file.ChunkBitmap(), peers})
+  }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  if !found {
+    http.Error(w, "unknown file", http.StatusNotFound)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(data))
+}
+
+func NameGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  w.WriteHeader(http.StatusOK)
+  w.Header().Set("Content-Type", "application/json")
+
+  json, err := json.Marshal(ToReturnedNames(gossiper.RegisteredNames()))
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+func ToReturnedNames(names []*TxPublish) []*ReturnedName {
+  list := make([]*ReturnedName, 0, len(names))
+  for _, tx := range names {
+    list = append(list, &ReturnedName{tx.Name, tx.Size, hex.EncodeToString(tx.MetafileHash)})
+  }
+  return list
+}
+
+// Agreed log of paxos naming, in commit order, and our claims still waiting for a majority
+func ConsensusGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  if gossiper.Consensus == nil {
+    http.Error(w, "paxos naming is disabled", http.StatusNotFound)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  json, err := json.Marshal(&struct {
+    Nodes int
+    Log []*ReturnedName
+    Pending []*ReturnedName
+  }{
+    gossiper.Consensus.Nodes,
+    ToReturnedNames(gossiper.Consensus.Names()),
+    ToReturnedNames(gossiper.Consensus.Pending()),
+  })
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+// Counts of the packets dropped by validation, by variant.
+func RejectedGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var data []byte
+  var err error
+  if !gossiper.Do(func() { data, err = json.Marshal(gossiper.Rejected) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(data))
+}
+
+// Whether packets between neighbors are authenticated, our identity key, and
+// the neighbors we completed the handshake with.
+func LinkGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  link := struct {
+    Enabled bool
+    PublicKey string
+    Established []string
+  }{Established: []string{}}
+  if gossiper.Link != nil {
+    link.Enabled = true
+    link.PublicKey = gossiper.Link.PublicKey()
+    link.Established = gossiper.Link.Established()
+  }
+  json, err := json.Marshal(&link)
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+func BansGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var bans []*BanInfo
+  if !gossiper.Do(func() { bans = gossiper.Bans() }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  json, err := json.Marshal(bans)
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+// Bans an address, CIDR or node name, for Duration seconds or forever if 0.
+func BansPostHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var rq struct {
+    Rule string
+    Duration int64
+  }
+  if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+    http.Error(w, "invalid JSON: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  if rq.Duration < 0 {
+    http.Error(w, "negative duration", http.StatusBadRequest)
+    return
+  }
+  var err error
+  if !gossiper.Do(func() { err = gossiper.Ban(rq.Rule, time.Duration(rq.Duration) * time.Second) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+func BanDeleteHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  found := false
+  if !gossiper.Do(func() { found = gossiper.Unban(mux.Vars(r)["rule"]) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  if !found {
+    http.Error(w, "no such ban", http.StatusNotFound)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+func DownloadsGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var data []byte
+  var err error
+  // Downloads change as the loop runs, so they are encoded on it
+  if !gossiper.Do(func() { data, err = json.Marshal(gossiper.DownloadList()) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(data))
+}
+
+// Applies change to the download of the hash in the path, answering 404 if
+// there is none and 409 if change can't apply to its state.
+func changeDownload(w http.ResponseWriter, r *http.Request, change func(gossiper *Gossiper, hash string) error) {
+  gossiper := gossiperFor(r)
+  hash := mux.Vars(r)["hash"]
+  found := false
+  var err error
+  if !gossiper.Do(func() {
+    if found = gossiper.Downloads[hash] != nil; found {
+      err = change(gossiper, hash)
+    }
+  }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  if !found {
+    http.Error(w, "no such download", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusConflict)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+func DownloadDeleteHandler(w http.ResponseWriter, r *http.Request) {
+  changeDownload(w, r, (*Gossiper).CancelDownload)
+}
+
+func DownloadPauseHandler(w http.ResponseWriter, r *http.Request) {
+  changeDownload(w, r, (*Gossiper).PauseDownload)
+}
+
+func DownloadResumeHandler(w http.ResponseWriter, r *http.Request) {
+  changeDownload(w, r, (*Gossiper).ResumeDownload)
+}
+
+func DownloadPriorityHandler(w http.ResponseWriter, r *http.Request) {
+  var rq struct {
+    Priority int
+  }
+  if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+    http.Error(w, "invalid JSON: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  changeDownload(w, r, func(gossiper *Gossiper, hash string) error {
+    return gossiper.PrioritizeDownload(hash, rq.Priority)
+  })
+}
+
+func ChannelGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var channels []string
+  if !gossiper.Do(func() { channels = gossiper.ChannelsAsList() }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Header().Set("Content-Type", "application/json")
+
+  json, err := json.Marshal(channels)
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(json))
+}
+
+func ChannelPostHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  buf := new(bytes.Buffer)
+  buf.ReadFrom(r.Body)
+
+  joined := false
+  if !gossiper.Do(func() { joined = gossiper.JoinChannel(strings.TrimSpace(buf.String())) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+  } else if joined {
+    w.WriteHeader(http.StatusOK)
+  } else {
+    w.WriteHeader(http.StatusBadRequest)
+  }
+}
+
+func ChannelDeleteHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  if !gossiper.Do(func() { gossiper.LeaveChannel(mux.Vars(r)["name"]) }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+}
+
+func ChannelMessageGetHandler(w http.ResponseWriter, r *http.Request) {
+  gossiper := gossiperFor(r)
+  var data []byte
+  var err error
+  // History grows as the loop records rumors, so it is encoded on it
+  if !gossiper.Do(func() {
+    history := gossiper.ChannelHistory[mux.Vars(r)["name"]]
+    if history == nil {
+      history = []*RumorMessage{}
+    }
+    data, err = json.Marshal(history)
+  }) {
+    http.Error(w, "node stopped", http.StatusServiceUnavailable)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Header().Set("Content-Type", "application/json")
+
+  FailIfErr(w, http.StatusInternalServerError, err)
+  io.WriteString(w, string(data))
+}
+
 func FailIfErr(w http.ResponseWriter, statusCode int, err error) {
   if err != nil {
     w.WriteHeader(statusCode)
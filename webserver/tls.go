@@ -0,0 +1,72 @@
+package webserver
+
+import (
+  "os"
+  "net"
+  "time"
+  "math/big"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "path/filepath"
+)
+
+var CERT_VALIDITY = 365 * 24 * time.Hour
+
+// Returns the certificate and key files of dir, creating a self-signed pair
+// for localhost and the bind address if there is none yet.
+func LoadOrCreateCertificate(dir, bindAddr string) (string, string, error) {
+  certFile := filepath.Join(dir, "cert.pem")
+  keyFile := filepath.Join(dir, "key.pem")
+  if _, err := os.Stat(certFile); err == nil {
+    if _, err := os.Stat(keyFile); err == nil {
+      return certFile, keyFile, nil
+    }
+  }
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return "", "", err
+  }
+  serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+  if err != nil {
+    return "", "", err
+  }
+  template := &x509.Certificate{
+    SerialNumber: serial,
+    Subject: pkix.Name{CommonName: "Peerster"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(CERT_VALIDITY),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    DNSNames: []string{"localhost"},
+    IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+  }
+  if ip := net.ParseIP(bindAddr); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+    template.IPAddresses = append(template.IPAddresses, ip)
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+  if err != nil {
+    return "", "", err
+  }
+  keyDer, err := x509.MarshalECPrivateKey(key)
+  if err != nil {
+    return "", "", err
+  }
+
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return "", "", err
+  }
+  certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+  if err := os.WriteFile(certFile, certPem, 0644); err != nil {
+    return "", "", err
+  }
+  keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+  if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+    return "", "", err
+  }
+  return certFile, keyFile, nil
+}